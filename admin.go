@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/geo"
+	"github.com/lancetw/hcfd-forecast-v1/hooks"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+)
+
+// maxAreaSize bounds an uploaded GeoJSON document
+const maxAreaSize = 1 << 20
+
+// adminAuthorized checks the "Authorization: Bearer" header against ADMIN_TOKEN
+func adminAuthorized(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// areaSummary is an area as listed by /admin/areas
+type areaSummary struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Polygons int    `json:"polygons"`
+}
+
+// areasHandler lists (GET), uploads (PUT ?id=&name= with a GeoJSON body) and deletes (DELETE ?id=) areas
+func areasHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	lg := logger.Std.With(logger.Fields{"request": logger.NewID(), "path": r.URL.Path})
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.Close()
+
+	id := r.URL.Query().Get("id")
+
+	switch r.Method {
+	case "GET":
+		areas, loadErr := geo.LoadAreas(c)
+		if loadErr != nil {
+			lg.Error("LoadAreas redis error", loadErr)
+			http.Error(w, loadErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		summaries := []areaSummary{}
+		for _, area := range areas {
+			summaries = append(summaries, areaSummary{area.ID, area.Name, len(area.Polygons)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summaries)
+
+	case "PUT", "POST":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = id
+		}
+
+		body, readErr := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAreaSize))
+		if readErr != nil {
+			http.Error(w, readErr.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		area, saveErr := geo.SaveArea(c, id, name, body)
+		if saveErr != nil {
+			lg.Warn("Area rejected", logger.Fields{"area": id, "error": saveErr.Error()})
+			http.Error(w, saveErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		lg.Info("Area saved", logger.Fields{"area": area.ID, "polygons": len(area.Polygons)})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(areaSummary{area.ID, area.Name, len(area.Polygons)})
+
+	case "DELETE":
+		if deleteErr := geo.DeleteArea(c, id); deleteErr != nil {
+			lg.Error("DeleteArea redis error", deleteErr)
+			http.Error(w, deleteErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		lg.Info("Area deleted", logger.Fields{"area": id})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// hooksHandler lists (GET), saves (PUT with a JSON hook) and deletes (DELETE ?id=) webhook
+// subscriptions; secrets are only shown when saved
+func hooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	lg := logger.Std.With(logger.Fields{"request": logger.NewID(), "path": r.URL.Path})
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.Close()
+
+	switch r.Method {
+	case "GET":
+		list, loadErr := hooks.LoadAll(c)
+		if loadErr != nil {
+			lg.Error("Load hooks redis error", loadErr)
+			http.Error(w, loadErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redacted := []hooks.Hook{}
+		for _, h := range list {
+			h.Secret = ""
+			redacted = append(redacted, h)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(redacted)
+
+	case "PUT", "POST":
+		var h hooks.Hook
+		if decodeErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&h); decodeErr != nil {
+			http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		saved, saveErr := hooks.Save(c, h)
+		if saveErr == hooks.ErrID || saveErr == hooks.ErrURL {
+			lg.Warn("Hook rejected", logger.Fields{"hook": h.ID, "error": saveErr.Error()})
+			http.Error(w, saveErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if saveErr != nil {
+			lg.Error("Save hook redis error", saveErr)
+			http.Error(w, saveErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		lg.Info("Hook saved", logger.Fields{"hook": saved.ID})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if deleteErr := hooks.Delete(c, id); deleteErr != nil {
+			lg.Error("Delete hook redis error", deleteErr)
+			http.Error(w, deleteErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		lg.Info("Hook deleted", logger.Fields{"hook": id})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// hookHistoryHandler shows the latest delivery attempts of ?id=, newest first
+func hookHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.Close()
+
+	records, historyErr := hooks.History(c, r.URL.Query().Get("id"))
+	if historyErr != nil {
+		logger.Std.Error("Hook history redis error", historyErr)
+		http.Error(w, historyErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// hookTestHandler posts a sample event to ?id= right away and returns the attempt (POST)
+func hookTestHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.Close()
+
+	h, ok, loadErr := hooks.Load(c, r.URL.Query().Get("id"))
+	if loadErr != nil {
+		http.Error(w, loadErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	record, testErr := hooks.Test(r.Context(), c, h)
+	if testErr != nil {
+		logger.Std.Error("Hook history redis error", testErr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
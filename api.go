@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/metrics"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+)
+
+// defaultRateLimit is the requests per minute allowed per API key; API_RATE_LIMIT overrides it
+const defaultRateLimit = 60
+
+var apiRequests = metrics.NewCounter(
+	"api_requests_total",
+	"API requests, by endpoint and status code.",
+	"endpoint", "code")
+
+var rateLimitErrors = metrics.NewCounter(
+	"api_rate_limit_errors_total",
+	"API requests let through unlimited because Redis was unavailable.")
+
+// apiKeys reads the accepted keys from API_KEYS, comma separated
+func apiKeys() []string {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// apiKey returns the key of r if it is accepted, from X-API-Key or "Authorization: Bearer"
+func apiKey(r *http.Request) (string, bool) {
+	given := r.Header.Get("X-API-Key")
+	if h := r.Header.Get("Authorization"); given == "" && strings.HasPrefix(h, "Bearer ") {
+		given = strings.TrimPrefix(h, "Bearer ")
+	}
+	if given == "" {
+		return "", false
+	}
+	for _, key := range apiKeys() {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func rateLimit() int {
+	if n, err := strconv.Atoi(os.Getenv("API_RATE_LIMIT")); err == nil && n > 0 {
+		return n
+	}
+	return defaultRateLimit
+}
+
+// allow counts a request of key in the current minute, returning the remaining requests;
+// requests are let through when Redis is unavailable, which is logged and counted
+func allow(ctx context.Context, key string, now time.Time) (int, bool) {
+	lg := logger.FromContext(ctx)
+	limit := rateLimit()
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		rateLimitErrors.Inc()
+		lg.Warn("Rate limit unavailable, request let through")
+		return limit, true
+	}
+	defer c.Close()
+
+	window := "ratelimit:" + logger.HashID(key) + ":" + strconv.FormatInt(now.Unix()/60, 10)
+	c.Send("MULTI")
+	c.Send("INCR", window)
+	c.Send("EXPIRE", window, 60)
+	values, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		rateLimitErrors.Inc()
+		lg.Error("Rate limit redis error", err)
+		return limit, true
+	}
+
+	count, _ := redis.Int(values[0], nil)
+	return limit - count, count <= limit
+}
+
+// setCORS allows the origins of API_CORS_ORIGINS, comma separated or "*"
+func setCORS(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	for _, allowed := range strings.Split(os.Getenv("API_CORS_ORIGINS"), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || allowed == origin {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-API-Key, Last-Event-ID")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+}
+
+// apiHandler wraps an endpoint with CORS, API key auth and rate limiting
+func apiHandler(endpoint string, h func(ctx context.Context, r *http.Request) (interface{}, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setCORS(w, r)
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		lg := logger.Std.With(logger.Fields{"request": logger.NewID(), "endpoint": endpoint})
+		ctx := logger.NewContext(context.Background(), lg)
+
+		writeJSON := func(v interface{}, code int) {
+			apiRequests.Inc(endpoint, strconv.Itoa(code))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(v)
+		}
+
+		if r.Method != "GET" {
+			writeJSON(apiError{"method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+
+		key, ok := apiKey(r)
+		if !ok {
+			writeJSON(apiError{"invalid API key"}, http.StatusUnauthorized)
+			return
+		}
+
+		remaining, allowed := allow(ctx, key, time.Now())
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rateLimit()))
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(60-time.Now().Second()))
+			writeJSON(apiError{"rate limit exceeded"}, http.StatusTooManyRequests)
+			return
+		}
+
+		v, code := h(ctx, r)
+		lg.Debug("API request", logger.Fields{"key": logger.HashID(key), "code": code, "query": r.URL.RawQuery})
+		writeJSON(v, code)
+	}
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiStation is a rain gauge with its readings
+type apiStation struct {
+	ID        string             `json:"id"`
+	Name      string             `json:"name"`
+	City      string             `json:"city"`
+	Town      string             `json:"town"`
+	Lat       float32            `json:"lat"`
+	Lng       float32            `json:"lng"`
+	Elevation float32            `json:"elevation"`
+	Time      *time.Time         `json:"time,omitempty"`
+	Readings  map[string]float32 `json:"readings,omitempty"`
+}
+
+func newAPIStation(s rain.Station, readings bool) apiStation {
+	station := apiStation{
+		ID:        s.ID,
+		Name:      s.Name,
+		City:      s.City,
+		Town:      s.Town,
+		Lat:       s.Lat,
+		Lng:       s.Lng,
+		Elevation: s.Elevation,
+	}
+	if readings {
+		t := s.Time
+		station.Time = &t
+		station.Readings = s.Readings
+	}
+	return station
+}
+
+// apiRain is the body of /api/v1/rain
+type apiRain struct {
+	Observed time.Time    `json:"observed"`
+	Stale    bool         `json:"stale"`
+	Stations []apiStation `json:"stations"`
+}
+
+// rainEndpoint serves the readings of ?station= (ID or name), or of the stations in ?city= and ?town=;
+// ?town= needs ?city= since town names repeat across counties
+func rainEndpoint(ctx context.Context, r *http.Request) (interface{}, int) {
+	query := r.URL.Query()
+	if query.Get("station") == "" && query.Get("town") != "" && query.Get("city") == "" {
+		return apiError{"town requires city"}, http.StatusBadRequest
+	}
+
+	locations, _, err := rain.FetchRaining(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("API FetchRaining error", err)
+		return apiError{"CWB data unavailable"}, http.StatusBadGateway
+	}
+
+	var stations []rain.Station
+	if station := query.Get("station"); station != "" {
+		stations = rain.NewStationIndex(locations).Lookup(station)
+	} else {
+		target := rain.Target{City: query.Get("city"), Town: query.Get("town")}
+		for _, location := range locations {
+			s := rain.NewStation(location)
+			if target.City == "" || target.Matches(s.City, s.Town) {
+				stations = append(stations, s)
+			}
+		}
+	}
+
+	observed := rain.LatestObservation(locations)
+	body := apiRain{
+		Observed: observed,
+		Stale:    rain.Stale("O-A0002-001", observed, time.Now()),
+		Stations: []apiStation{},
+	}
+	for _, s := range stations {
+		body.Stations = append(body.Stations, newAPIStation(s, true))
+	}
+	return body, http.StatusOK
+}
+
+// stationsEndpoint lists every rain gauge without readings
+func stationsEndpoint(ctx context.Context, r *http.Request) (interface{}, int) {
+	locations, _, err := rain.FetchRaining(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("API FetchRaining error", err)
+		return apiError{"CWB data unavailable"}, http.StatusBadGateway
+	}
+
+	stations := []apiStation{}
+	for _, location := range locations {
+		stations = append(stations, newAPIStation(rain.NewStation(location), false))
+	}
+	return stations, http.StatusOK
+}
+
+// apiWarning is one hazard in effect for a county
+type apiWarning struct {
+	County        string    `json:"county"`
+	Phenomena     string    `json:"phenomena"`
+	Significance  string    `json:"significance"`
+	Level         string    `json:"level"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	AffectedAreas []string  `json:"affected_areas"`
+}
+
+// warningsEndpoint lists the hazards in effect, of ?county= if given
+func warningsEndpoint(ctx context.Context, r *http.Request) (interface{}, int) {
+	v, err := rain.FetchWarnings(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("API FetchWarnings error", err)
+		return apiError{"CWB data unavailable"}, http.StatusBadGateway
+	}
+
+	county := r.URL.Query().Get("county")
+	now := time.Now()
+
+	warnings := []apiWarning{}
+	for _, location := range v.Location {
+		if county != "" && location.Name != county {
+			continue
+		}
+		for _, hazard := range location.Hazards {
+			if !hazard.Active(now) {
+				continue
+			}
+			areas := hazard.AffectedAreas()
+			if areas == nil {
+				areas = []string{}
+			}
+			warnings = append(warnings, apiWarning{
+				County:        location.Name,
+				Phenomena:     hazard.Phenomena(),
+				Significance:  hazard.Significance(),
+				Level:         hazard.Level().String(),
+				Start:         hazard.ValidTime.StartTime,
+				End:           hazard.ValidTime.EndTime,
+				AffectedAreas: areas,
+			})
+		}
+	}
+	return warnings, http.StatusOK
+}
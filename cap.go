@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/capalert"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/history"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+)
+
+// defaultCAPSender identifies our CAP alerts; CAP_SENDER overrides it
+const defaultCAPSender = "hcfd-forecast"
+
+// capSeverities maps the levels onto CAP severities
+var capSeverities = map[rain.Level]string{
+	rain.LevelWatch:               "Minor",
+	rain.LevelHeavy:               "Moderate",
+	rain.LevelExtremelyHeavy:      "Severe",
+	rain.LevelTorrential:          "Extreme",
+	rain.LevelExtremelyTorrential: "Extreme",
+	rain.LevelWind:                "Severe",
+	rain.LevelTyphoon:             "Extreme",
+}
+
+func capSender() string {
+	if sender := os.Getenv("CAP_SENDER"); sender != "" {
+		return sender
+	}
+	return defaultCAPSender
+}
+
+// capWindow is how far back the issued alerts are searched for those still in effect
+const capWindow = 7 * 24 * time.Hour
+
+// capLifetime is how long an issued alert without an expiry is served
+const capLifetime = 24 * time.Hour
+
+// currentAlerts returns the alerts issued by the worker that are still in effect at now and
+// were not cancelled or updated since, for every county with history, including the custom
+// regions and areas of subscribers
+func currentAlerts(c redis.Conn, now time.Time) ([]history.Entry, error) {
+	entries, err := history.Since(c, now.Add(-capWindow))
+	if err != nil {
+		return nil, err
+	}
+	retracted, err := history.Retracted(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var current []history.Entry
+	seen := map[string]bool{}
+	for _, e := range entries {
+		expires := e.Expires
+		if expires.IsZero() {
+			expires = e.Issued.Add(capLifetime)
+		}
+		if !expires.After(now) || seen[e.Alert] || (e.Ref != "" && retracted[e.Ref]) {
+			continue
+		}
+		seen[e.Alert] = true
+		current = append(current, e)
+	}
+	return current, nil
+}
+
+// toCAP converts an issued alert into a CAP 1.2 message
+func toCAP(e history.Entry, location *time.Location) *capalert.Alert {
+	sent := e.Issued.In(location).Truncate(time.Second)
+	info := capalert.Info{
+		Language:    "zh-TW",
+		Category:    []string{"Met"},
+		Event:       "天氣警特報",
+		Urgency:     "Expected",
+		Severity:    capSeverities[rain.Level(e.Grade)],
+		Certainty:   "Likely",
+		Effective:   &sent,
+		SenderName:  capSender(),
+		Headline:    strings.SplitN(strings.TrimSpace(e.Text), "\n", 2)[0],
+		Description: strings.TrimSpace(e.Text),
+		Area:        []capalert.Area{{Desc: e.Region}},
+	}
+	if !e.Expires.IsZero() {
+		expires := e.Expires.In(location).Truncate(time.Second)
+		info.Expires = &expires
+	}
+	if e.Dataset == "O-A0002-001" {
+		info.Event = "雨量警示"
+		info.Urgency = "Immediate"
+		info.Certainty = "Observed"
+	}
+	if info.Severity == "" {
+		info.Severity = "Unknown"
+	}
+
+	return &capalert.Alert{
+		Identifier: capSender() + "-" + e.Alert,
+		Sender:     capSender(),
+		Sent:       sent,
+		Status:     "Actual",
+		MsgType:    "Alert",
+		Scope:      "Public",
+		Info:       []capalert.Info{info},
+	}
+}
+
+// capHandler serves the alerts in effect as an Atom feed of inline CAP 1.2 messages
+func capHandler(w http.ResponseWriter, r *http.Request) {
+	lg := logger.Std.With(logger.Fields{"request": logger.NewID(), "path": r.URL.Path})
+
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		location = time.Local
+	}
+	now := time.Now().In(location).Truncate(time.Second)
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	entries, err := currentAlerts(c, now)
+	c.Close()
+	if err != nil {
+		lg.Error("CAP redis error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	self := "http://" + r.Host + r.URL.Path
+	feed := capalert.Feed{
+		ID:      "urn:" + capSender() + ":cap",
+		Title:   "新竹天氣警示 CAP",
+		Updated: now,
+		Link:    []capalert.Link{{Rel: "self", Href: self}},
+	}
+
+	for _, e := range entries {
+		message := toCAP(e, location)
+		feed.Entry = append(feed.Entry, capalert.Entry{
+			ID:      "urn:" + message.Identifier,
+			Title:   message.Info[0].Headline,
+			Updated: message.Sent,
+			Content: &capalert.Content{Type: "application/cap+xml", Alert: message},
+		})
+	}
+
+	data, marshalErr := xml.MarshalIndent(feed, "", "  ")
+	if marshalErr != nil {
+		lg.Error("CAP marshal error", marshalErr)
+		http.Error(w, marshalErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	w.Write(data)
+}
@@ -0,0 +1,184 @@
+package capalert
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Namespace of CAP 1.2 documents
+const Namespace = "urn:oasis:names:tc:emergency:cap:1.2"
+
+// AtomNamespace of the feeds listing CAP documents
+const AtomNamespace = "http://www.w3.org/2005/Atom"
+
+// ErrPolygon is returned for a polygon that is not a closed ring of "lat,lon" pairs
+var ErrPolygon = errors.New("capalert: malformed polygon")
+
+// Alert is a CAP 1.2 alert message
+type Alert struct {
+	XMLName    xml.Name  `xml:"urn:oasis:names:tc:emergency:cap:1.2 alert"`
+	Identifier string    `xml:"identifier"`
+	Sender     string    `xml:"sender"`
+	Sent       time.Time `xml:"sent"`
+	Status     string    `xml:"status"`
+	MsgType    string    `xml:"msgType"`
+	Scope      string    `xml:"scope"`
+	References string    `xml:"references,omitempty"`
+	Info       []Info    `xml:"info"`
+}
+
+// Info is one info block of an alert, usually one per language
+type Info struct {
+	Language    string     `xml:"language,omitempty"`
+	Category    []string   `xml:"category"`
+	Event       string     `xml:"event"`
+	Urgency     string     `xml:"urgency"`
+	Severity    string     `xml:"severity"`
+	Certainty   string     `xml:"certainty"`
+	Effective   *time.Time `xml:"effective,omitempty"`
+	Onset       *time.Time `xml:"onset,omitempty"`
+	Expires     *time.Time `xml:"expires,omitempty"`
+	SenderName  string     `xml:"senderName,omitempty"`
+	Headline    string     `xml:"headline,omitempty"`
+	Description string     `xml:"description,omitempty"`
+	Instruction string     `xml:"instruction,omitempty"`
+	Web         string     `xml:"web,omitempty"`
+	Area        []Area     `xml:"area"`
+}
+
+// Area is an area of an info block
+type Area struct {
+	Desc    string    `xml:"areaDesc"`
+	Polygon []string  `xml:"polygon,omitempty"`
+	Circle  []string  `xml:"circle,omitempty"`
+	Geocode []Geocode `xml:"geocode,omitempty"`
+}
+
+// Geocode is a coded area, e.g. a Taiwan town code
+type Geocode struct {
+	ValueName string `xml:"valueName"`
+	Value     string `xml:"value"`
+}
+
+// Point is a WGS 84 coordinate
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+// Parse decodes a CAP 1.2 alert
+func Parse(data []byte) (*Alert, error) {
+	a := &Alert{}
+	if err := xml.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ReferencedIDs returns the identifiers of the messages that a Cancel or Update refers to;
+// references are space separated "sender,identifier,sent" triples
+func (a *Alert) ReferencedIDs() []string {
+	var ids []string
+	for _, triple := range strings.Fields(a.References) {
+		if parts := strings.Split(triple, ","); len(parts) == 3 && parts[1] != "" {
+			ids = append(ids, parts[1])
+		}
+	}
+	return ids
+}
+
+// Active reports whether the info block is in effect at t
+func (info Info) Active(t time.Time) bool {
+	return info.Expires == nil || info.Expires.After(t)
+}
+
+// Polygons parses the polygons of the area
+func (area Area) Polygons() ([][]Point, error) {
+	var polygons [][]Point
+	for _, s := range area.Polygon {
+		polygon, err := ParsePolygon(s)
+		if err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, polygon)
+	}
+	return polygons, nil
+}
+
+// ParsePolygon parses a CAP polygon, a closed ring of space separated "lat,lon" pairs
+func ParsePolygon(s string) ([]Point, error) {
+	var polygon []Point
+	for _, pair := range strings.Fields(s) {
+		parts := strings.Split(pair, ",")
+		if len(parts) != 2 {
+			return nil, ErrPolygon
+		}
+		lat, latErr := strconv.ParseFloat(parts[0], 64)
+		lon, lonErr := strconv.ParseFloat(parts[1], 64)
+		if latErr != nil || lonErr != nil {
+			return nil, ErrPolygon
+		}
+		polygon = append(polygon, Point{Lat: lat, Lon: lon})
+	}
+	if len(polygon) < 4 || polygon[0] != polygon[len(polygon)-1] {
+		return nil, ErrPolygon
+	}
+	return polygon, nil
+}
+
+// Feed is an Atom feed listing CAP alerts
+type Feed struct {
+	XMLName xml.Name  `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated time.Time `xml:"updated"`
+	Link    []Link    `xml:"link"`
+	Entry   []Entry   `xml:"entry"`
+}
+
+// Entry is one alert of a feed, linked or inline
+type Entry struct {
+	ID      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated time.Time `xml:"updated"`
+	Link    []Link    `xml:"link"`
+	Content *Content  `xml:"content,omitempty"`
+}
+
+// Link of a feed or entry
+type Link struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// Content carries an inline alert
+type Content struct {
+	Type  string `xml:"type,attr"`
+	Alert *Alert `xml:"urn:oasis:names:tc:emergency:cap:1.2 alert"`
+}
+
+// ParseFeed decodes an Atom feed of CAP alerts
+func ParseFeed(data []byte) (*Feed, error) {
+	f := &Feed{}
+	if err := xml.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Href returns the alternate link of the entry, or its first link
+func (e Entry) Href() string {
+	for _, link := range e.Link {
+		if link.Rel == "" || link.Rel == "alternate" {
+			return link.Href
+		}
+	}
+	if len(e.Link) > 0 {
+		return e.Link[0].Href
+	}
+	return ""
+}
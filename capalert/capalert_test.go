@@ -0,0 +1,116 @@
+package capalert
+
+import (
+	"testing"
+	"time"
+)
+
+const sample = `<?xml version="1.0" encoding="UTF-8"?>
+<alert xmlns="urn:oasis:names:tc:emergency:cap:1.2">
+  <identifier>CWB-Weather_extremely-rain_202306020800</identifier>
+  <sender>weather@cwb.gov.tw</sender>
+  <sent>2023-06-02T08:00:00+08:00</sent>
+  <status>Actual</status>
+  <msgType>Update</msgType>
+  <scope>Public</scope>
+  <references>weather@cwb.gov.tw,CWB-Weather_extremely-rain_202306020500,2023-06-02T05:00:00+08:00 weather@cwb.gov.tw,CWB-Weather_extremely-rain_202306020200,2023-06-02T02:00:00+08:00</references>
+  <info>
+    <language>zh-TW</language>
+    <category>Met</category>
+    <event>降雨</event>
+    <urgency>Future</urgency>
+    <severity>Severe</severity>
+    <certainty>Likely</certainty>
+    <expires>2023-06-02T20:00:00+08:00</expires>
+    <headline>豪雨特報</headline>
+    <area>
+      <areaDesc>新竹縣山區</areaDesc>
+      <polygon>24.80,121.00 24.80,121.30 24.50,121.30 24.50,121.00 24.80,121.00</polygon>
+      <geocode><valueName>Taiwan_Geocode_103</valueName><value>10004</value></geocode>
+    </area>
+  </info>
+</alert>`
+
+func TestParse(t *testing.T) {
+	a, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Identifier != "CWB-Weather_extremely-rain_202306020800" || a.MsgType != "Update" || a.Status != "Actual" {
+		t.Errorf("header = %q %q %q", a.Identifier, a.MsgType, a.Status)
+	}
+	if len(a.Info) != 1 || len(a.Info[0].Area) != 1 {
+		t.Fatalf("got %d info blocks", len(a.Info))
+	}
+	info := a.Info[0]
+	if info.Severity != "Severe" || info.Headline != "豪雨特報" || info.Area[0].Desc != "新竹縣山區" {
+		t.Errorf("info = %q %q %q", info.Severity, info.Headline, info.Area[0].Desc)
+	}
+	if info.Area[0].Geocode[0].Value != "10004" {
+		t.Errorf("geocode = %v", info.Area[0].Geocode)
+	}
+
+	ids := a.ReferencedIDs()
+	if len(ids) != 2 || ids[0] != "CWB-Weather_extremely-rain_202306020500" || ids[1] != "CWB-Weather_extremely-rain_202306020200" {
+		t.Errorf("ReferencedIDs = %v", ids)
+	}
+
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2023, 6, 2, 11, 59, 0, 0, time.UTC), true},
+		{time.Date(2023, 6, 2, 12, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := info.Active(tt.t); got != tt.want {
+			t.Errorf("Active(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestParsePolygon(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      string
+		points int
+		err    error
+	}{
+		{"closed ring", "24.8,121.0 24.8,121.3 24.5,121.3 24.8,121.0", 4, nil},
+		{"extra spaces", "  24.8,121.0  24.8,121.3\n24.5,121.3 24.8,121.0 ", 4, nil},
+		{"open ring", "24.8,121.0 24.8,121.3 24.5,121.3 24.5,121.0", 0, ErrPolygon},
+		{"too short", "24.8,121.0 24.8,121.3 24.8,121.0", 0, ErrPolygon},
+		{"spaces between lat and lon", "24.8 121.0 24.8 121.3 24.5 121.3 24.8 121.0", 0, ErrPolygon},
+		{"not a number", "24.8,x 24.8,121.3 24.5,121.3 24.8,x", 0, ErrPolygon},
+	}
+	for _, tt := range tests {
+		polygon, err := ParsePolygon(tt.s)
+		if err != tt.err || len(polygon) != tt.points {
+			t.Errorf("%s: got %d points, %v; want %d, %v", tt.name, len(polygon), err, tt.points, tt.err)
+		}
+	}
+
+	polygon, _ := ParsePolygon("24.8,121.0 24.8,121.3 24.5,121.3 24.8,121.0")
+	if polygon[1] != (Point{Lat: 24.8, Lon: 121.3}) {
+		t.Errorf("second point = %v, want lat 24.8 lon 121.3", polygon[1])
+	}
+}
+
+func TestReferencedIDs(t *testing.T) {
+	tests := []struct {
+		references string
+		want       int
+	}{
+		{"", 0},
+		{"sender,id1,2023-06-02T05:00:00+08:00", 1},
+		{"sender,id1,2023-06-02T05:00:00+08:00 sender,id2,2023-06-02T06:00:00+08:00", 2},
+		{"malformed sender,,2023-06-02T05:00:00+08:00", 0},
+	}
+	for _, tt := range tests {
+		a := &Alert{References: tt.references}
+		if got := a.ReferencedIDs(); len(got) != tt.want {
+			t.Errorf("ReferencedIDs(%q) = %v, want %d", tt.references, got, tt.want)
+		}
+	}
+}
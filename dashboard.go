@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/geo"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+	"github.com/lancetw/hcfd-forecast-v1/status"
+)
+
+// map size of the dashboard, in SVG units
+const (
+	mapWidth   = 640
+	mapHeight  = 480
+	mapPadding = 30
+)
+
+// dashStation is a watched rain gauge placed on the map
+type dashStation struct {
+	rain.Station
+	Grade rain.Level
+	X, Y  float64
+}
+
+// dashWarning is a hazard in effect with its validity
+type dashWarning struct {
+	County       string
+	Phenomena    string
+	Significance string
+	Level        rain.Level
+	End          time.Time
+}
+
+type dashboard struct {
+	Counties []string
+	Now      time.Time
+	Observed time.Time
+	Stale    bool
+	Stations []dashStation
+	Outlines []string
+	Warnings []dashWarning
+	Report   *status.Report
+	Width    int
+	Height   int
+}
+
+type byLevel []dashStation
+
+func (s byLevel) Len() int      { return len(s) }
+func (s byLevel) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLevel) Less(i, j int) bool {
+	if s[i].Grade != s[j].Grade {
+		return s[i].Grade > s[j].Grade
+	}
+	return s[i].Readings["RAIN"] > s[j].Readings["RAIN"]
+}
+
+// mapOutlines are simplified outlines of Hsinchu County and Hsinchu City, coast included
+var mapOutlines = []geo.Polygon{
+	{{
+		{Lon: 121.01, Lat: 24.98}, {Lon: 121.06, Lat: 24.95}, {Lon: 121.10, Lat: 24.89},
+		{Lon: 121.17, Lat: 24.87}, {Lon: 121.24, Lat: 24.82}, {Lon: 121.29, Lat: 24.74},
+		{Lon: 121.37, Lat: 24.66}, {Lon: 121.42, Lat: 24.57}, {Lon: 121.39, Lat: 24.48},
+		{Lon: 121.31, Lat: 24.42}, {Lon: 121.23, Lat: 24.45}, {Lon: 121.15, Lat: 24.53},
+		{Lon: 121.08, Lat: 24.58}, {Lon: 121.02, Lat: 24.63}, {Lon: 120.96, Lat: 24.67},
+		{Lon: 120.91, Lat: 24.70}, {Lon: 120.87, Lat: 24.72}, {Lon: 120.88, Lat: 24.76},
+		{Lon: 120.91, Lat: 24.81}, {Lon: 120.94, Lat: 24.86}, {Lon: 120.97, Lat: 24.93},
+		{Lon: 121.01, Lat: 24.98},
+	}},
+	{{
+		{Lon: 120.91, Lat: 24.85}, {Lon: 120.97, Lat: 24.84}, {Lon: 121.02, Lat: 24.81},
+		{Lon: 121.04, Lat: 24.77}, {Lon: 121.00, Lat: 24.74}, {Lon: 120.95, Lat: 24.73},
+		{Lon: 120.91, Lat: 24.72}, {Lon: 120.87, Lat: 24.72}, {Lon: 120.88, Lat: 24.76},
+		{Lon: 120.91, Lat: 24.81}, {Lon: 120.91, Lat: 24.85},
+	}},
+}
+
+// projection maps lon/lat onto the dashboard map
+type projection struct {
+	minLon, maxLat float64
+	scale          float64
+}
+
+// newProjection fits points into the map, keeping the aspect of their extent
+func newProjection(points []geo.Point) projection {
+	if len(points) == 0 {
+		return projection{scale: 1}
+	}
+
+	b := geo.Bounds{Min: points[0], Max: points[0]}
+	for _, p := range points {
+		if p.Lat < b.Min.Lat {
+			b.Min.Lat = p.Lat
+		}
+		if p.Lat > b.Max.Lat {
+			b.Max.Lat = p.Lat
+		}
+		if p.Lon < b.Min.Lon {
+			b.Min.Lon = p.Lon
+		}
+		if p.Lon > b.Max.Lon {
+			b.Max.Lon = p.Lon
+		}
+	}
+
+	spanLat, spanLon := b.Max.Lat-b.Min.Lat, b.Max.Lon-b.Min.Lon
+	if spanLat == 0 {
+		spanLat = 1
+	}
+	if spanLon == 0 {
+		spanLon = 1
+	}
+	scale := float64(mapWidth-2*mapPadding) / spanLon
+	if s := float64(mapHeight-2*mapPadding) / spanLat; s < scale {
+		scale = s
+	}
+	return projection{minLon: b.Min.Lon, maxLat: b.Max.Lat, scale: scale}
+}
+
+// xy returns the map position of p
+func (pr projection) xy(p geo.Point) (float64, float64) {
+	return mapPadding + (p.Lon-pr.minLon)*pr.scale, mapPadding + (pr.maxLat-p.Lat)*pr.scale
+}
+
+// path renders the outer ring of poly as SVG path data
+func (pr projection) path(poly geo.Polygon) string {
+	if len(poly) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	for i, p := range poly[0] {
+		x, y := pr.xy(p)
+		if i == 0 {
+			fmt.Fprintf(&buf, "M%.1f %.1f", x, y)
+		} else {
+			fmt.Fprintf(&buf, "L%.1f %.1f", x, y)
+		}
+	}
+	buf.WriteString("Z")
+	return buf.String()
+}
+
+// placeStations projects the stations and outlines onto the map with one scaling,
+// returning the SVG path data of the outlines
+func placeStations(stations []dashStation, outlines []geo.Polygon) []string {
+	var points []geo.Point
+	for _, s := range stations {
+		points = append(points, geo.Point{Lon: float64(s.Lng), Lat: float64(s.Lat)})
+	}
+	for _, poly := range outlines {
+		if len(poly) > 0 {
+			points = append(points, poly[0]...)
+		}
+	}
+	pr := newProjection(points)
+
+	for i := range stations {
+		stations[i].X, stations[i].Y = pr.xy(geo.Point{Lon: float64(stations[i].Lng), Lat: float64(stations[i].Lat)})
+	}
+
+	var paths []string
+	for _, poly := range outlines {
+		paths = append(paths, pr.path(poly))
+	}
+	return paths
+}
+
+// remaining renders the time left until end
+func remaining(end time.Time, now time.Time) string {
+	if end.IsZero() {
+		return "—"
+	}
+	d := end.Sub(now)
+	if d <= 0 {
+		return "已到期"
+	}
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%d 天 %d 小時", int(d.Hours())/24, int(d.Hours())%24)
+	}
+	return fmt.Sprintf("%d 小時 %d 分", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// loadDashboard gathers the stations and warnings of the watched counties and the worker status
+func loadDashboard(ctx context.Context, now time.Time) dashboard {
+	lg := logger.FromContext(ctx)
+	d := dashboard{Now: now, Width: mapWidth, Height: mapHeight}
+	for _, region := range regions {
+		if city := rain.ParseTarget(region).City; !containsString(d.Counties, city) {
+			d.Counties = append(d.Counties, city)
+		}
+	}
+
+	locations, _, err := rain.FetchRaining(ctx)
+	if err != nil {
+		lg.Error("Dashboard FetchRaining error", err)
+		d.Outlines = placeStations(nil, mapOutlines)
+	} else {
+		for _, location := range locations {
+			s := rain.NewStation(location)
+			if _, ok := matchRegion(s); ok {
+				d.Stations = append(d.Stations, dashStation{Station: s, Grade: s.Level()})
+			}
+		}
+		d.Outlines = placeStations(d.Stations, mapOutlines)
+		sort.Sort(byLevel(d.Stations))
+		d.Observed = rain.LatestObservation(locations)
+		d.Stale = rain.Stale("O-A0002-001", d.Observed, now)
+	}
+
+	warnings, err := rain.FetchWarnings(ctx)
+	if err != nil {
+		lg.Error("Dashboard FetchWarnings error", err)
+	} else {
+		for _, location := range warnings.Location {
+			if !containsString(d.Counties, location.Name) {
+				continue
+			}
+			for _, hazard := range location.Hazards {
+				if hazard.Active(now) {
+					d.Warnings = append(d.Warnings, dashWarning{
+						County:       location.Name,
+						Phenomena:    hazard.Phenomena(),
+						Significance: hazard.Significance(),
+						Level:        hazard.Level(),
+						End:          hazard.ValidTime.EndTime,
+					})
+				}
+			}
+		}
+	}
+
+	if c := db.Connect(os.Getenv("REDISTOGO_URL")); c != nil {
+		d.Report, err = status.Load(c)
+		c.Close()
+		if err != nil {
+			lg.Error("Dashboard status redis error", err)
+		}
+	}
+
+	return d
+}
+
+// matchRegion returns the selectable region a station lies in
+func matchRegion(s rain.Station) (string, bool) {
+	for _, region := range regions {
+		if rain.ParseTarget(region).Matches(s.City, s.Town) {
+			return region, true
+		}
+	}
+	return "", false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"local": func(t time.Time) string {
+		if t.IsZero() {
+			return "—"
+		}
+		if location, err := time.LoadLocation(timeZone); err == nil {
+			t = t.In(location)
+		}
+		return t.Format("01/02 15:04")
+	},
+	"remaining": remaining,
+	"reading": func(s dashStation, element string) string {
+		if v, ok := s.Readings[element]; ok && v >= 0 {
+			return fmt.Sprintf("%.1f", v)
+		}
+		return "-"
+	},
+}).Parse(dashboardHTML))
+
+// homeHandler renders the dashboard of the duty officers
+func homeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	lg := logger.Std.With(logger.Fields{"request": logger.NewID(), "path": r.URL.Path})
+	ctx := logger.NewContext(context.Background(), lg)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, loadDashboard(ctx, time.Now())); err != nil {
+		lg.Error("Dashboard template error", err)
+	}
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="zh-TW">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="120">
+<title>新竹天氣警示 值班面板</title>
+<style>
+body { font-family: sans-serif; margin: 0; background: #f4f5f7; color: #222; }
+header { background: #1d3557; color: #fff; padding: 12px 20px; }
+header h1 { font-size: 20px; margin: 0; }
+header small { opacity: .8; }
+main { display: grid; grid-template-columns: repeat(auto-fit, minmax(420px, 1fr)); gap: 16px; padding: 16px; }
+section { background: #fff; border-radius: 6px; padding: 12px 16px; box-shadow: 0 1px 2px rgba(0,0,0,.1); }
+h2 { font-size: 16px; margin: 0 0 8px; }
+table { border-collapse: collapse; width: 100%; font-size: 14px; }
+th, td { padding: 4px 6px; border-bottom: 1px solid #eee; text-align: left; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+.l0 { background: #fff; } .l1 { background: #e0f3ff; } .l2 { background: #fff3b0; }
+.l3 { background: #ffc078; } .l4 { background: #ff8787; } .l5 { background: #d0a0ff; }
+.l6 { background: #c3fae8; } .l7 { background: #ffa8a8; }
+circle.l0 { fill: #adb5bd; } circle.l1 { fill: #4dabf7; } circle.l2 { fill: #fcc419; }
+circle.l3 { fill: #fd7e14; } circle.l4 { fill: #f03e3e; } circle.l5 { fill: #9c36b5; }
+svg { width: 100%; height: auto; background: #eef4f8; border-radius: 4px; }
+svg text { font-size: 10px; fill: #333; }
+svg path.outline { fill: #fdfdf6; stroke: #8a9199; stroke-width: 1; stroke-linejoin: round; }
+.stale { color: #c92a2a; font-weight: bold; }
+.legend span { display: inline-block; padding: 0 6px; margin-right: 4px; border-radius: 3px; font-size: 12px; }
+</style>
+</head>
+<body>
+<header>
+<h1>新竹天氣警示 值班面板</h1>
+<small>更新時間 {{local .Now}}・觀測時間 {{local .Observed}}{{if .Stale}} <span class="stale">資料逾時</span>{{end}}</small>
+</header>
+<main>
+<section>
+<h2>雨量站</h2>
+<p class="legend"><span class="l1">警示</span><span class="l2">大雨</span><span class="l3">豪雨</span><span class="l4">大豪雨</span><span class="l5">超大豪雨</span></p>
+<table>
+<tr><th>測站</th><th>地區</th><th>10分鐘</th><th>時雨量</th><th>3小時</th><th>24小時</th><th>等級</th></tr>
+{{range .Stations}}<tr class="l{{printf "%d" .Grade}}"><td>{{.Name}}</td><td>{{.City}}{{.Town}}</td><td class="n">{{reading . "MIN_10"}}</td><td class="n">{{reading . "RAIN"}}</td><td class="n">{{reading . "HOUR_3"}}</td><td class="n">{{reading . "HOUR_24"}}</td><td>{{.Grade}}</td></tr>
+{{else}}<tr><td colspan="7">無雨量資料</td></tr>
+{{end}}</table>
+</section>
+<section>
+<h2>測站分布</h2>
+<svg viewBox="0 0 {{.Width}} {{.Height}}" role="img" aria-label="雨量站分布圖">
+{{range .Outlines}}<path class="outline" d="{{.}}"/>
+{{end}}{{range .Stations}}<g><title>{{.Name}} {{.City}}{{.Town}} 時雨量 {{reading . "RAIN"}}</title><circle class="l{{printf "%d" .Grade}}" cx="{{printf "%.1f" .X}}" cy="{{printf "%.1f" .Y}}" r="6" stroke="#333" stroke-width=".5"/>{{if .Grade}}<text x="{{printf "%.1f" .X}}" y="{{printf "%.1f" .Y}}" dx="8" dy="3">{{.Name}}</text>{{end}}</g>
+{{end}}</svg>
+</section>
+<section>
+<h2>生效中的特報</h2>
+<table>
+<tr><th>縣市</th><th>特報</th><th>到期</th><th>剩餘</th></tr>
+{{range .Warnings}}<tr class="l{{printf "%d" .Level}}"><td>{{.County}}</td><td>{{.Phenomena}}{{.Significance}}</td><td>{{local .End}}</td><td class="countdown" data-end="{{.End.Unix}}">{{remaining .End $.Now}}</td></tr>
+{{else}}<tr><td colspan="4">目前無特報</td></tr>
+{{end}}</table>
+</section>
+<section>
+<h2>背景程序</h2>
+{{with .Report}}<table>
+<tr><th>工作</th><th>上次執行</th><th>耗時</th><th>執行者</th></tr>
+{{range .Jobs}}<tr><td>{{.Name}}</td><td>{{local .Start}}</td><td>{{.Duration}}</td><td>{{.Owner}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>資料集</th><th>上次下載</th><th>觀測時間</th></tr>
+{{range .Fetches}}<tr><td>{{.Dataset}}</td><td>{{local .Time}}</td><td>{{local .Observed}}</td></tr>
+{{end}}</table>
+{{else}}<p class="stale">無法讀取背景程序狀態</p>{{end}}
+</section>
+</main>
+<script>
+(function () {
+  function tick() {
+    var now = Date.now() / 1000;
+    var cells = document.querySelectorAll(".countdown");
+    for (var i = 0; i < cells.length; i++) {
+      var end = parseInt(cells[i].getAttribute("data-end"), 10);
+      if (end <= 0) { continue; }
+      var d = end - now;
+      if (d <= 0) { cells[i].textContent = "已到期"; continue; }
+      var h = Math.floor(d / 3600), m = Math.floor(d % 3600 / 60);
+      cells[i].textContent = h >= 24 ? Math.floor(h / 24) + " 天 " + h % 24 + " 小時" : h + " 小時 " + m + " 分";
+    }
+  }
+  setInterval(tick, 30000);
+  var counties = {{.Counties}};
+  function watched(region) {
+    region = (region || "").replace(/台/g, "臺");
+    for (var i = 0; i < counties.length; i++) {
+      if (region.indexOf(counties[i].replace(/台/g, "臺")) === 0) { return true; }
+    }
+    return false;
+  }
+  if (window.EventSource) {
+    var source = new EventSource("/stream");
+    ["new", "updated", "cleared"].forEach(function (type) {
+      source.addEventListener(type, function (e) {
+        try {
+          if (watched(JSON.parse(e.data).region)) { location.reload(); }
+        } catch (err) {}
+      });
+    });
+  }
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// cacheRetention keeps entries around for conditional GET long after they are stale
+const cacheRetention = 24 * time.Hour
+
+// DatasetCache stores downloaded datasets as the fields of the "cache:<dataset>" hashes
+type DatasetCache struct {
+	URL string
+}
+
+// Get returns the fields cached for dataset, empty when there are none
+func (d DatasetCache) Get(dataset string) (map[string]string, error) {
+	c := Connect(d.URL)
+	if c == nil {
+		return nil, errors.New("redis unavailable")
+	}
+	defer c.Close()
+
+	return redis.StringMap(c.Do("HGETALL", "cache:"+dataset))
+}
+
+// Set stores the fields of a downloaded dataset
+func (d DatasetCache) Set(dataset string, fields map[string]string) error {
+	c := Connect(d.URL)
+	if c == nil {
+		return errors.New("redis unavailable")
+	}
+	defer c.Close()
+
+	key := "cache:" + dataset
+	c.Send("MULTI")
+	c.Send("HMSET", redis.Args{}.Add(key).AddFlat(fields)...)
+	c.Send("EXPIRE", key, int(cacheRetention/time.Second))
+	_, err := c.Do("EXEC")
+	return err
+}
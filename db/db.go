@@ -1,18 +1,56 @@
 package db
 
 import (
-	"log"
+	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/metrics"
 )
 
+var redisDuration = metrics.NewHistogram(
+	"redis_operation_duration_seconds",
+	"Latency of Redis commands.",
+	metrics.DefBuckets,
+	"command")
+
+var redisErrors = metrics.NewCounter(
+	"redis_operation_errors_total",
+	"Redis commands that returned an error.",
+	"command")
+
 // Connect database connection helper
 func Connect(url string) redis.Conn {
+	start := time.Now()
 	c, redisErr := redis.DialURL(url)
+	redisDuration.Observe(time.Since(start).Seconds(), "DIAL")
 	if redisErr != nil {
-		log.Println("Connect to redis error", redisErr)
+		redisErrors.Inc("DIAL")
+		logger.Std.Error("Connect to redis error", redisErr)
 		return nil
 	}
 
-	return c
+	return &instrumentedConn{c}
+}
+
+// instrumentedConn records the latency of every command sent through Do
+type instrumentedConn struct {
+	redis.Conn
+}
+
+func (c *instrumentedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	command := strings.ToUpper(commandName)
+	if command == "" {
+		command = "FLUSH"
+	}
+
+	start := time.Now()
+	reply, err := c.Conn.Do(commandName, args...)
+	redisDuration.Observe(time.Since(start).Seconds(), command)
+	if err != nil && err != redis.ErrNil {
+		redisErrors.Inc(command)
+	}
+
+	return reply, err
 }
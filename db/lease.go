@@ -0,0 +1,112 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNotHeld is returned when the lease belongs to somebody else
+var ErrNotHeld = errors.New("lease not held")
+
+var renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// acquireScript takes KEYS[1] when it is free, drawing the fencing token from KEYS[2]
+// only then, so failed attempts do not advance it
+var acquireScript = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return -1
+end
+local token = redis.call("INCR", KEYS[2])
+redis.call("SET", KEYS[1], ARGV[1] .. ":" .. token, "PX", ARGV[2])
+return token`)
+
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// claimScript records ARGV[2] in the sorted set KEYS[2] scored by when it was last claimed,
+// dropping members unclaimed since ARGV[4]; sets of older versions are converted first
+var claimScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return -1
+end
+if redis.call("TYPE", KEYS[2]).ok == "set" then
+	local members = redis.call("SMEMBERS", KEYS[2])
+	redis.call("DEL", KEYS[2])
+	for _, member in ipairs(members) do
+		redis.call("ZADD", KEYS[2], ARGV[3], member)
+	end
+end
+local seen = redis.call("ZSCORE", KEYS[2], ARGV[2])
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[4])
+if seen then
+	return 0
+end
+return 1`)
+
+// Lease is a Redis lock (SET NX PX) held by one owner until it expires
+type Lease struct {
+	Key   string
+	Owner string
+	TTL   time.Duration
+
+	// Token is the fencing token, increasing with every acquisition
+	Token int64
+}
+
+func (l *Lease) value() string {
+	return fmt.Sprintf("%s:%d", l.Owner, l.Token)
+}
+
+// Acquire takes the lease on key for owner, or returns ErrNotHeld
+func Acquire(c redis.Conn, key string, owner string, ttl time.Duration) (*Lease, error) {
+	token, err := redis.Int64(acquireScript.Do(c, key, key+":fence", owner, int64(ttl/time.Millisecond)))
+	if err != nil {
+		return nil, err
+	}
+	if token < 0 {
+		return nil, ErrNotHeld
+	}
+	return &Lease{Key: key, Owner: owner, TTL: ttl, Token: token}, nil
+}
+
+// Renew extends the lease by its TTL if it is still held
+func (l *Lease) Renew(c redis.Conn) error {
+	n, err := redis.Int(renewScript.Do(c, l.Key, l.value(), int64(l.TTL/time.Millisecond)))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// Release gives the lease up if it is still held
+func (l *Lease) Release(c redis.Conn) error {
+	_, err := releaseScript.Do(c, l.Key, l.value())
+	return err
+}
+
+// Claim records member in set at now only while the lease is held, reporting whether it
+// was new; members not claimed again within retention are dropped, so set stays bounded
+func (l *Lease) Claim(c redis.Conn, set string, member string, now time.Time, retention time.Duration) (bool, error) {
+	n, err := redis.Int(claimScript.Do(c, l.Key, set, l.value(), member, now.Unix(), now.Add(-retention).Unix()))
+	if err != nil {
+		return false, err
+	}
+	if n < 0 {
+		return false, ErrNotHeld
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/history"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+)
+
+// feedLength is the number of entries of a feed unless ?limit= asks otherwise
+const feedLength = 50
+
+// maxFeedLength bounds ?limit=
+const maxFeedLength = 200
+
+// allRegions names the feed of every region
+const allRegions = "all"
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated time.Time   `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Entry   []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Updated   time.Time    `xml:"updated"`
+	Published time.Time    `xml:"published"`
+	Category  atomCategory `xml:"category"`
+	Content   atomContent  `xml:"content"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Language      string    `xml:"language"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Item          []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Category    string  `xml:"category"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+// entryBody renders the alert text followed by its region, grade and validity
+func entryBody(e history.Entry, location *time.Location) string {
+	validity := "—"
+	if !e.Expires.IsZero() {
+		validity = e.Expires.In(location).Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("%s\n\n地區：%s\n等級：%s\n有效至：%s",
+		strings.TrimSpace(e.Text), e.Region, e.Level, validity)
+}
+
+// feedHandler serves the issued alerts as /feeds/<county>.atom or .rss, or /feeds/all.atom for every region
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	lg := logger.Std.With(logger.Fields{"request": logger.NewID(), "path": r.URL.Path})
+
+	name := strings.TrimPrefix(r.URL.Path, "/feeds/")
+	format := ""
+	switch {
+	case strings.HasSuffix(name, ".atom"):
+		format, name = "atom", strings.TrimSuffix(name, ".atom")
+	case strings.HasSuffix(name, ".rss"):
+		format, name = "rss", strings.TrimSuffix(name, ".rss")
+	}
+	if format == "" || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	county, title := name, "新竹天氣警示 "+name
+	if name == allRegions {
+		county, title = "", "新竹天氣警示"
+	}
+
+	limit := feedLength
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxFeedLength {
+		limit = maxFeedLength
+	}
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	entries, err := history.Recent(c, county, limit)
+	c.Close()
+	if err != nil {
+		lg.Error("Feed redis error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		location = time.Local
+	}
+	updated := time.Now().In(location).Truncate(time.Second)
+	if len(entries) > 0 {
+		updated = entries[0].Issued.In(location).Truncate(time.Second)
+	}
+
+	self := "http://" + r.Host + r.URL.EscapedPath()
+	var v interface{}
+	if format == "atom" {
+		feed := atomFeed{
+			ID:      "urn:" + capSender() + ":feed:" + name,
+			Title:   title,
+			Updated: updated,
+			Link:    []atomLink{{Rel: "self", Href: self}},
+			Entry:   []atomEntry{},
+		}
+		for _, e := range entries {
+			issued := e.Issued.In(location).Truncate(time.Second)
+			feed.Entry = append(feed.Entry, atomEntry{
+				ID:        "urn:" + capSender() + ":alert:" + e.ID,
+				Title:     e.Title(),
+				Updated:   issued,
+				Published: issued,
+				Category:  atomCategory{Term: e.Level},
+				Content:   atomContent{Type: "text", Body: entryBody(e, location)},
+			})
+		}
+		v = feed
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	} else {
+		feed := rssFeed{
+			Version: "2.0",
+			Channel: rssChannel{
+				Title:         title,
+				Link:          self,
+				Description:   title + " 已發布的警示",
+				Language:      "zh-TW",
+				LastBuildDate: updated.Format(time.RFC1123Z),
+			},
+		}
+		for _, e := range entries {
+			feed.Channel.Item = append(feed.Channel.Item, rssItem{
+				Title:       e.Title(),
+				GUID:        rssGUID{ID: "urn:" + capSender() + ":alert:" + e.ID},
+				PubDate:     e.Issued.In(location).Format(time.RFC1123Z),
+				Category:    e.Level,
+				Description: entryBody(e, location),
+			})
+		}
+		v = feed
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	}
+
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		lg.Error("Feed marshal error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, xml.Header)
+	w.Write(data)
+}
@@ -0,0 +1,261 @@
+package geo
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// errors
+var (
+	ErrGeometry    = errors.New("geo: unsupported geometry")
+	ErrCoordinates = errors.New("geo: malformed coordinates")
+)
+
+// Point is a WGS 84 coordinate, in GeoJSON order
+type Point struct {
+	Lon float64
+	Lat float64
+}
+
+// Polygon is an outer ring followed by its holes; rings are closed
+type Polygon [][]Point
+
+// Bounds is the bounding box of a polygon
+type Bounds struct {
+	Min Point
+	Max Point
+}
+
+// Contains reports whether p lies within b, edges included
+func (b Bounds) Contains(p Point) bool {
+	return p.Lon >= b.Min.Lon && p.Lon <= b.Max.Lon && p.Lat >= b.Min.Lat && p.Lat <= b.Max.Lat
+}
+
+// Overlaps reports whether b and other share a point
+func (b Bounds) Overlaps(other Bounds) bool {
+	return b.Min.Lon <= other.Max.Lon && other.Min.Lon <= b.Max.Lon &&
+		b.Min.Lat <= other.Max.Lat && other.Min.Lat <= b.Max.Lat
+}
+
+// Area is a named set of polygons such as a response district
+type Area struct {
+	ID       string
+	Name     string
+	Polygons []Polygon
+}
+
+// Bounds is the bounding box of the outer ring
+func (poly Polygon) Bounds() Bounds {
+	if len(poly) == 0 || len(poly[0]) == 0 {
+		return Bounds{}
+	}
+	b := Bounds{Min: poly[0][0], Max: poly[0][0]}
+	for _, p := range poly[0][1:] {
+		b.Min.Lon, b.Max.Lon = min(b.Min.Lon, p.Lon), max(b.Max.Lon, p.Lon)
+		b.Min.Lat, b.Max.Lat = min(b.Min.Lat, p.Lat), max(b.Max.Lat, p.Lat)
+	}
+	return b
+}
+
+// Contains reports whether p lies inside the polygon and outside its holes
+func (poly Polygon) Contains(p Point) bool {
+	if len(poly) == 0 || !poly.Bounds().Contains(p) || !inRing(poly[0], p) {
+		return false
+	}
+	for _, hole := range poly[1:] {
+		if inRing(hole, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersects reports whether the outer rings of the polygons overlap
+func (poly Polygon) Intersects(other Polygon) bool {
+	if len(poly) == 0 || len(other) == 0 || !poly.Bounds().Overlaps(other.Bounds()) {
+		return false
+	}
+	a, b := poly[0], other[0]
+
+	for i := 0; i+1 < len(a); i++ {
+		for j := 0; j+1 < len(b); j++ {
+			if segmentsIntersect(a[i], a[i+1], b[j], b[j+1]) {
+				return true
+			}
+		}
+	}
+	return inRing(b, a[0]) || inRing(a, b[0])
+}
+
+// Contains reports whether p lies in one of the polygons of the area
+func (area Area) Contains(p Point) bool {
+	for _, poly := range area.Polygons {
+		if poly.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersects reports whether poly overlaps one of the polygons of the area
+func (area Area) Intersects(poly Polygon) bool {
+	for _, own := range area.Polygons {
+		if own.Intersects(poly) {
+			return true
+		}
+	}
+	return false
+}
+
+// inRing casts a ray from p towards increasing longitude and counts the edges it crosses
+func inRing(ring []Point, p Point) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func orientation(a Point, b Point, c Point) float64 {
+	return (b.Lon-a.Lon)*(c.Lat-a.Lat) - (b.Lat-a.Lat)*(c.Lon-a.Lon)
+}
+
+func onSegment(a Point, b Point, p Point) bool {
+	return p.Lon >= min(a.Lon, b.Lon) && p.Lon <= max(a.Lon, b.Lon) &&
+		p.Lat >= min(a.Lat, b.Lat) && p.Lat <= max(a.Lat, b.Lat)
+}
+
+func segmentsIntersect(p1 Point, p2 Point, q1 Point, q2 Point) bool {
+	d1 := orientation(q1, q2, p1)
+	d2 := orientation(q1, q2, p2)
+	d3 := orientation(p1, p2, q1)
+	d4 := orientation(p1, p2, q2)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(q1, q2, p1)) ||
+		(d2 == 0 && onSegment(q1, q2, p2)) ||
+		(d3 == 0 && onSegment(p1, p2, q1)) ||
+		(d4 == 0 && onSegment(p1, p2, q2))
+}
+
+func min(a float64, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Features    []geoJSON       `json:"features"`
+}
+
+// ParseGeoJSON reads the polygons of a Polygon, MultiPolygon, GeometryCollection,
+// Feature or FeatureCollection
+func ParseGeoJSON(data []byte) ([]Polygon, error) {
+	var g geoJSON
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	polygons, err := g.polygons()
+	if err != nil {
+		return nil, err
+	}
+	if len(polygons) == 0 {
+		return nil, ErrGeometry
+	}
+	return polygons, nil
+}
+
+func (g geoJSON) polygons() ([]Polygon, error) {
+	switch g.Type {
+	case "Polygon":
+		var coordinates [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+			return nil, ErrCoordinates
+		}
+		poly, err := polygon(coordinates)
+		if err != nil {
+			return nil, err
+		}
+		return []Polygon{poly}, nil
+
+	case "MultiPolygon":
+		var coordinates [][][][]float64
+		if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+			return nil, ErrCoordinates
+		}
+		var polygons []Polygon
+		for _, c := range coordinates {
+			poly, err := polygon(c)
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, poly)
+		}
+		return polygons, nil
+
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, ErrGeometry
+		}
+		return g.Geometry.polygons()
+
+	case "FeatureCollection", "GeometryCollection":
+		members := g.Features
+		if g.Type == "GeometryCollection" {
+			members = g.Geometries
+		}
+		var polygons []Polygon
+		for _, member := range members {
+			found, err := member.polygons()
+			if err == ErrGeometry {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, found...)
+		}
+		return polygons, nil
+	}
+
+	return nil, ErrGeometry
+}
+
+func polygon(coordinates [][][]float64) (Polygon, error) {
+	var poly Polygon
+	for _, c := range coordinates {
+		var ring []Point
+		for _, position := range c {
+			if len(position) < 2 {
+				return nil, ErrCoordinates
+			}
+			ring = append(ring, Point{Lon: position[0], Lat: position[1]})
+		}
+		if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+			return nil, ErrCoordinates
+		}
+		poly = append(poly, ring)
+	}
+	if len(poly) == 0 {
+		return nil, ErrCoordinates
+	}
+	return poly, nil
+}
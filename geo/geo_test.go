@@ -0,0 +1,93 @@
+package geo
+
+import "testing"
+
+// square is a 4 by 4 square with a hole in its centre
+var square = Polygon{
+	{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}},
+	{{1.5, 1.5}, {2.5, 1.5}, {2.5, 2.5}, {1.5, 2.5}, {1.5, 1.5}},
+}
+
+func TestPolygonContains(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Point
+		want bool
+	}{
+		{"inside", Point{1, 1}, true},
+		{"in hole", Point{2, 2}, false},
+		{"outside", Point{5, 1}, false},
+		{"beyond bounds", Point{-1, -1}, false},
+		{"near corner", Point{3.9, 3.9}, true},
+	}
+	for _, tt := range tests {
+		if got := square.Contains(tt.p); got != tt.want {
+			t.Errorf("%s: Contains(%v) = %v, want %v", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestPolygonIntersects(t *testing.T) {
+	tests := []struct {
+		name  string
+		other Polygon
+		want  bool
+	}{
+		{"crossing edges", Polygon{{{3, 3}, {6, 3}, {6, 6}, {3, 6}, {3, 3}}}, true},
+		{"contained", Polygon{{{0.5, 0.5}, {1, 0.5}, {1, 1}, {0.5, 0.5}}}, true},
+		{"containing", Polygon{{{-1, -1}, {5, -1}, {5, 5}, {-1, 5}, {-1, -1}}}, true},
+		{"touching corner", Polygon{{{4, 4}, {5, 4}, {5, 5}, {4, 4}}}, true},
+		{"disjoint", Polygon{{{5, 5}, {6, 5}, {6, 6}, {5, 5}}}, false},
+		{"bounds overlap only", Polygon{{{3.8, 4.5}, {4.5, 3.8}, {4.5, 4.5}, {3.8, 4.5}}}, false},
+	}
+	for _, tt := range tests {
+		if got := square.Intersects(tt.other); got != tt.want {
+			t.Errorf("%s: Intersects = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBounds(t *testing.T) {
+	b := Polygon{{{1, 2}, {3, -1}, {-2, 5}, {1, 2}}}.Bounds()
+	if want := (Bounds{Min: Point{-2, -1}, Max: Point{3, 5}}); b != want {
+		t.Fatalf("Bounds = %v, want %v", b, want)
+	}
+
+	tests := []struct {
+		name  string
+		other Bounds
+		want  bool
+	}{
+		{"same", b, true},
+		{"shared edge", Bounds{Min: Point{3, 0}, Max: Point{4, 1}}, true},
+		{"inside", Bounds{Min: Point{0, 0}, Max: Point{1, 1}}, true},
+		{"east", Bounds{Min: Point{3.1, 0}, Max: Point{4, 1}}, false},
+		{"north", Bounds{Min: Point{0, 5.1}, Max: Point{1, 6}}, false},
+	}
+	for _, tt := range tests {
+		if got := b.Overlaps(tt.other); got != tt.want {
+			t.Errorf("%s: Overlaps = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		polygons int
+		err      error
+	}{
+		{"polygon", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}`, 1, nil},
+		{"multipolygon", `{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[2,2],[3,2],[3,3],[2,2]]]]}`, 2, nil},
+		{"feature collection", `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}},{"type":"Feature","geometry":{"type":"Point","coordinates":[0,0]}}]}`, 1, nil},
+		{"open ring", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}`, 0, ErrCoordinates},
+		{"point", `{"type":"Point","coordinates":[0,0]}`, 0, ErrGeometry},
+	}
+	for _, tt := range tests {
+		polygons, err := ParseGeoJSON([]byte(tt.data))
+		if err != tt.err || len(polygons) != tt.polygons {
+			t.Errorf("%s: got %d polygons, %v; want %d, %v", tt.name, len(polygons), err, tt.polygons, tt.err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package geo
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrAreaID is returned for an area ID that is not a short slug
+var ErrAreaID = errors.New("geo: area ID must be 1-32 letters, digits, '-' or '_'")
+
+var areaID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func areaKey(id string) string {
+	return "area:" + id
+}
+
+// SaveArea stores the GeoJSON of the area id under name, in the "area:<id>" hash
+func SaveArea(c redis.Conn, id string, name string, geojson []byte) (Area, error) {
+	if !areaID.MatchString(id) {
+		return Area{}, ErrAreaID
+	}
+
+	polygons, err := ParseGeoJSON(geojson)
+	if err != nil {
+		return Area{}, err
+	}
+
+	c.Send("MULTI")
+	c.Send("SADD", "areas", id)
+	c.Send("HMSET", areaKey(id), "name", name, "geojson", geojson)
+	if _, err := c.Do("EXEC"); err != nil {
+		return Area{}, err
+	}
+
+	return Area{ID: id, Name: name, Polygons: polygons}, nil
+}
+
+// DeleteArea removes the area id
+func DeleteArea(c redis.Conn, id string) error {
+	c.Send("MULTI")
+	c.Send("SREM", "areas", id)
+	c.Send("DEL", areaKey(id))
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// LoadArea reads the area id, reporting false when it does not exist
+func LoadArea(c redis.Conn, id string) (Area, bool, error) {
+	values, err := redis.StringMap(c.Do("HGETALL", areaKey(id)))
+	if err != nil || len(values) == 0 {
+		return Area{}, false, err
+	}
+
+	polygons, err := ParseGeoJSON([]byte(values["geojson"]))
+	if err != nil {
+		return Area{}, false, err
+	}
+	return Area{ID: id, Name: values["name"], Polygons: polygons}, true, nil
+}
+
+// LoadAreas reads every stored area, sorted by ID
+func LoadAreas(c redis.Conn) ([]Area, error) {
+	ids, err := redis.Strings(c.Do("SMEMBERS", "areas"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	var areas []Area
+	for _, id := range ids {
+		area, ok, loadErr := LoadArea(c, id)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		if ok {
+			areas = append(areas, area)
+		}
+	}
+	return areas, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/status"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// defaultMaxFetchAge is how old the last CWB fetch may be before /readyz fails
+const defaultMaxFetchAge = 15 * time.Minute
+
+// credentialsTTL is how long a LINE credentials check is cached
+const credentialsTTL = 5 * time.Minute
+
+var credentials struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok")
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	fail := func(name string, err error) {
+		checks[name] = err.Error()
+		ready = false
+	}
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		fail("redis", fmt.Errorf("connect failed"))
+	} else {
+		defer c.Close()
+
+		if _, pingErr := c.Do("PING"); pingErr != nil {
+			fail("redis", pingErr)
+		} else {
+			checks["redis"] = "ok"
+
+			maxAge := defaultMaxFetchAge
+			if d, parseErr := time.ParseDuration(os.Getenv("READY_MAX_FETCH_AGE")); parseErr == nil {
+				maxAge = d
+			}
+
+			fetch, fetchErr := status.LastFetch(c, "O-A0002-001")
+			switch {
+			case fetchErr != nil:
+				fail("cwb", fetchErr)
+			case time.Since(fetch.Time) > maxAge:
+				fail("cwb", fmt.Errorf("last fetch at %s", fetch.Time.Format(time.RFC3339)))
+			default:
+				checks["cwb"] = "ok"
+			}
+		}
+	}
+
+	if credentialsErr := checkCredentials(); credentialsErr != nil {
+		fail("line", credentialsErr)
+	} else {
+		checks["line"] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(checks)
+}
+
+// checkCredentials asks the LINE API whether the channel access token is valid
+func checkCredentials() error {
+	credentials.Lock()
+	defer credentials.Unlock()
+
+	if time.Since(credentials.checked) < credentialsTTL {
+		return credentials.err
+	}
+
+	req, err := http.NewRequest("GET", linebot.APIEndpointBase+"/v2/bot/info", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("ACCESS_TOKEN"))
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Do(req)
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			err = fmt.Errorf("LINE API status %d", res.StatusCode)
+		}
+	}
+
+	credentials.checked = time.Now()
+	credentials.err = err
+	return err
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.Close()
+
+	report, loadErr := status.Load(c)
+	if loadErr != nil {
+		logger.Std.Error("Status redis error", loadErr)
+		http.Error(w, loadErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,184 @@
+package history
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+)
+
+// historyKey is the sorted set of issued alerts scored by issue time
+const historyKey = "history"
+
+// retractedKey is the sorted set of cancelled or updated CAP identifiers scored by retraction time
+const retractedKey = "history:retracted"
+
+// defaultRetention keeps a month of alerts; HISTORY_RETENTION overrides it
+const defaultRetention = 30 * 24 * time.Hour
+
+// Entry is one issued alert
+type Entry struct {
+	ID      string    `json:"id"`
+	Alert   string    `json:"alert"`
+	Dataset string    `json:"dataset"`
+	Region  string    `json:"region"`
+	Level   string    `json:"level"`
+	Grade   int       `json:"grade"`
+	Text    string    `json:"text"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+
+	// Ref is the identifier of the CAP message the alert comes from, if any
+	Ref string `json:"ref,omitempty"`
+}
+
+// Retention is how long alerts are kept, from HISTORY_RETENTION such as "720h"
+func Retention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("HISTORY_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultRetention
+}
+
+// NewEntry records alert issued at t
+func NewEntry(alert rain.Alert, t time.Time) Entry {
+	return Entry{
+		ID:      alert.ID() + "-" + t.UTC().Format("20060102T150405"),
+		Alert:   alert.ID(),
+		Dataset: alert.Dataset,
+		Region:  alert.Region,
+		Level:   alert.Level.String(),
+		Grade:   int(alert.Level),
+		Text:    alert.Text,
+		Issued:  t,
+		Expires: alert.Expires,
+		Ref:     alert.Ref,
+	}
+}
+
+// Title is the headline of the entry with its region and grade
+func (e Entry) Title() string {
+	title := strings.SplitN(strings.TrimSpace(e.Text), "\n", 2)[0]
+	if e.Level != "" {
+		title = "[" + e.Region + "・" + e.Level + "] " + title
+	} else {
+		title = "[" + e.Region + "] " + title
+	}
+	return title
+}
+
+// countyKey is the sorted set of the alerts issued in county; alerts of uploaded
+// areas are kept under their region
+func countyKey(county string) string {
+	return historyKey + ":" + normalize(county)
+}
+
+// County is the county under which an alert of region is indexed
+func County(region string) string {
+	if rain.IsAreaTarget(region) {
+		return region
+	}
+	return rain.ParseTarget(region).City
+}
+
+// Record stores entries and drops those older than the retention
+func Record(c redis.Conn, entries []Entry, now time.Time) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	oldest := now.Add(-Retention()).Unix()
+	counties := map[string]bool{}
+
+	c.Send("MULTI")
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			c.Do("DISCARD")
+			return err
+		}
+		key := countyKey(County(e.Region))
+		c.Send("ZADD", historyKey, e.Issued.Unix(), data)
+		c.Send("ZADD", key, e.Issued.Unix(), data)
+		counties[key] = true
+	}
+	c.Send("ZREMRANGEBYSCORE", historyKey, "-inf", oldest)
+	for key := range counties {
+		c.Send("ZREMRANGEBYSCORE", key, "-inf", oldest)
+	}
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// normalize folds 台 into 臺 as county names are spelled either way
+func normalize(s string) string {
+	return strings.Replace(s, "台", "臺", -1)
+}
+
+// Recent returns up to limit entries, newest first, of county or of every region
+func Recent(c redis.Conn, county string, limit int) ([]Entry, error) {
+	key := historyKey
+	if county != "" {
+		key = countyKey(county)
+	}
+	values, err := redis.ByteSlices(c.Do("ZREVRANGE", key, 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	return decode(values), nil
+}
+
+// Since returns the entries issued after t, newest first
+func Since(c redis.Conn, t time.Time) ([]Entry, error) {
+	values, err := redis.ByteSlices(c.Do("ZREVRANGEBYSCORE", historyKey, "+inf", "("+strconv.FormatInt(t.Unix(), 10)))
+	if err != nil {
+		return nil, err
+	}
+
+	return decode(values), nil
+}
+
+// Retract records that the CAP messages refs were cancelled or updated at now
+func Retract(c redis.Conn, refs map[string]bool, now time.Time) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	c.Send("MULTI")
+	for ref := range refs {
+		c.Send("ZADD", retractedKey, now.Unix(), ref)
+	}
+	c.Send("ZREMRANGEBYSCORE", retractedKey, "-inf", now.Add(-Retention()).Unix())
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Retracted returns the CAP identifiers recorded by Retract
+func Retracted(c redis.Conn) (map[string]bool, error) {
+	refs, err := redis.Strings(c.Do("ZRANGE", retractedKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	retracted := map[string]bool{}
+	for _, ref := range refs {
+		retracted[ref] = true
+	}
+	return retracted, nil
+}
+
+func decode(values [][]byte) []Entry {
+	entries := []Entry{}
+	for _, data := range values {
+		var e Entry
+		if json.Unmarshal(data, &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
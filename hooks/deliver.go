@@ -0,0 +1,275 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+)
+
+// pendingKey is the sorted set of deliveries scored by their next attempt
+const pendingKey = "hooks:pending"
+
+// MaxAttempts is the number of attempts before a delivery is given up
+const MaxAttempts = 6
+
+// historyLength is the number of attempts kept per hook
+const historyLength = 100
+
+// retryBase is the delay before the first retry, doubled on each further one
+const retryBase = 30 * time.Second
+
+// maxRetryDelay caps the delay between attempts
+const maxRetryDelay = time.Hour
+
+// dueBatch bounds the deliveries attempted by one Process
+const dueBatch = 50
+
+// inflightTimeout is how long a taken delivery waits before it is attempted again,
+// in case the worker attempting it stops
+const inflightTimeout = 5 * time.Minute
+
+// takeScript pushes the delivery ARGV[1] back to ARGV[2] + ARGV[3] if it is due at ARGV[2],
+// reporting whether it was
+var takeScript = redis.NewScript(1, `
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], tonumber(ARGV[2]) + tonumber(ARGV[3]), ARGV[1])
+return 1`)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Delivery is one event on its way to a hook
+type Delivery struct {
+	ID      string `json:"id"`
+	Hook    string `json:"hook"`
+	Event   Event  `json:"event"`
+	Attempt int    `json:"attempt"`
+}
+
+// Record is one attempt in the history of a hook
+type Record struct {
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	Attempt  int       `json:"attempt"`
+	Time     time.Time `json:"time"`
+	Status   int       `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Final    bool      `json:"final"`
+}
+
+func historyKey(id string) string {
+	return "hook:" + id + ":history"
+}
+
+// Backoff is the delay after the attempt-th failed attempt
+func Backoff(attempt int) time.Duration {
+	d := retryBase
+	for i := 1; i < attempt && d < maxRetryDelay; i++ {
+		d = d * 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// Enqueue schedules event for the hook id now
+func Enqueue(c redis.Conn, id string, event Event) error {
+	return schedule(c, Delivery{ID: logger.NewID(), Hook: id, Event: event}, time.Now())
+}
+
+func schedule(c redis.Conn, d Delivery, at time.Time) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("ZADD", pendingKey, at.Unix(), data)
+	return err
+}
+
+// Process attempts the deliveries due at now, rescheduling failures with backoff;
+// a delivery stays queued until its attempt is over, so one interrupted by a restart is
+// attempted again after inflightTimeout and receivers may see it twice (same X-Hook-Delivery)
+func Process(ctx context.Context, c redis.Conn, now time.Time) error {
+	lg := logger.FromContext(ctx)
+
+	due, err := redis.ByteSlices(c.Do("ZRANGEBYSCORE", pendingKey, "-inf", now.Unix(), "LIMIT", 0, dueBatch))
+	if err != nil {
+		return err
+	}
+
+	for _, data := range due {
+		// another worker may have taken it since ZRANGEBYSCORE
+		taken, takeErr := redis.Int(takeScript.Do(c, pendingKey, data, now.Unix(), int64(inflightTimeout/time.Second)))
+		if takeErr != nil {
+			return takeErr
+		}
+		if taken == 0 {
+			continue
+		}
+
+		var d Delivery
+		if unmarshalErr := json.Unmarshal(data, &d); unmarshalErr != nil {
+			lg.Error("Hook delivery error", unmarshalErr)
+			if _, remErr := c.Do("ZREM", pendingKey, data); remErr != nil {
+				return remErr
+			}
+			continue
+		}
+
+		h, ok, loadErr := Load(c, d.Hook)
+		if loadErr != nil {
+			return loadErr
+		}
+		if !ok {
+			if _, remErr := c.Do("ZREM", pendingKey, data); remErr != nil {
+				return remErr
+			}
+			continue
+		}
+
+		d.Attempt++
+		record := Send(ctx, h, d)
+		record.Final = record.Error == "" || d.Attempt >= MaxAttempts
+		if recordErr := appendHistory(c, h.ID, record); recordErr != nil {
+			lg.Error("Hook history redis error", recordErr)
+		}
+
+		fields := logger.Fields{"hook": h.ID, "delivery": d.ID, "attempt": d.Attempt, "status": record.Status}
+		switch {
+		case record.Error == "":
+			lg.Debug("Hook delivered", fields)
+		case record.Final:
+			lg.Error("Hook delivery given up", fmt.Errorf("%s", record.Error), fields)
+		default:
+			lg.Warn("Hook delivery failed, retrying", fields)
+		}
+
+		if record.Final {
+			if _, remErr := c.Do("ZREM", pendingKey, data); remErr != nil {
+				return remErr
+			}
+			continue
+		}
+		if rescheduleErr := reschedule(c, data, d, now.Add(Backoff(d.Attempt))); rescheduleErr != nil {
+			return rescheduleErr
+		}
+	}
+
+	return nil
+}
+
+// reschedule replaces the queued delivery data by d at the time at
+func reschedule(c redis.Conn, data []byte, d Delivery, at time.Time) error {
+	next, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	c.Send("MULTI")
+	c.Send("ZREM", pendingKey, data)
+	c.Send("ZADD", pendingKey, at.Unix(), next)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Send posts the event of d to h once, signed with its secret
+func Send(ctx context.Context, h Hook, d Delivery) Record {
+	record := Record{Delivery: d.ID, Event: d.Event.ID, Attempt: d.Attempt, Time: time.Now()}
+
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		record.Error = err.Error()
+		return record
+	}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		record.Error = err.Error()
+		return record
+	}
+
+	timestamp := strconv.FormatInt(record.Time.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hook-ID", h.ID)
+	req.Header.Set("X-Hook-Delivery", d.ID)
+	req.Header.Set("X-Hook-Timestamp", timestamp)
+	req.Header.Set("X-Hook-Signature", Sign(h.Secret, timestamp, body))
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		record.Error = err.Error()
+		return record
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+
+	record.Status = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		record.Error = res.Status
+	}
+	return record
+}
+
+func appendHistory(c redis.Conn, id string, record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	c.Send("MULTI")
+	c.Send("LPUSH", historyKey(id), data)
+	c.Send("LTRIM", historyKey(id), 0, historyLength-1)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Test posts a sample event to h now and records the attempt
+func Test(ctx context.Context, c redis.Conn, h Hook) (Record, error) {
+	d := Delivery{
+		ID:      logger.NewID(),
+		Hook:    h.ID,
+		Attempt: 1,
+		Event: Event{
+			ID:     "test",
+			Type:   "test",
+			Region: "新竹市",
+			Level:  "警示",
+			Grade:  1,
+			Text:   "【測試】webhook 測試訊息",
+			Time:   time.Now(),
+		},
+	}
+
+	record := Send(ctx, h, d)
+	record.Final = true
+	return record, appendHistory(c, h.ID, record)
+}
+
+// History returns the latest attempts of the hook id, newest first
+func History(c redis.Conn, id string) ([]Record, error) {
+	values, err := redis.ByteSlices(c.Do("LRANGE", historyKey(id), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for _, data := range values {
+		var record Record
+		if json.Unmarshal(data, &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,58 @@
+// Command hookecho is a local stand-in for a webhook receiver: it verifies the
+// signature of each delivery with HOOK_SECRET and logs the event.
+//
+// Set HOOK_FAIL=3 to answer the first three deliveries with 500 and exercise retries.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lancetw/hcfd-forecast-v1/hooks"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+)
+
+func main() {
+	addr := os.Getenv("ADDR")
+	if addr == "" {
+		addr = ":8090"
+	}
+	secret := os.Getenv("HOOK_SECRET")
+	failures, _ := strconv.ParseInt(os.Getenv("HOOK_FAIL"), 10, 64)
+
+	var received int64
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, readErr := ioutil.ReadAll(r.Body)
+		if readErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fields := logger.Fields{"hook": r.Header.Get("X-Hook-ID"), "delivery": r.Header.Get("X-Hook-Delivery")}
+		if !hooks.Verify(secret, r.Header.Get("X-Hook-Timestamp"), body, r.Header.Get("X-Hook-Signature")) {
+			logger.Std.Warn("Invalid signature", fields)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if atomic.AddInt64(&received, 1) <= failures {
+			logger.Std.Info("Failing on purpose", fields)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var event hooks.Event
+		json.Unmarshal(body, &event)
+		fields["event"] = event
+		logger.Std.Info("Delivery received", fields)
+	})
+
+	logger.Std.Info("hookecho listening", logger.Fields{"addr": addr})
+	if listenErr := http.ListenAndServe(addr, nil); listenErr != nil {
+		logger.Std.Error("ListenAndServe error", listenErr)
+	}
+}
@@ -0,0 +1,194 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+)
+
+// errors
+var (
+	ErrID  = errors.New("hooks: ID must be 1-32 letters, digits, '-' or '_'")
+	ErrURL = errors.New("hooks: URL must be http or https")
+)
+
+var hookID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Hook is a webhook subscription of an external system
+type Hook struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+
+	// Types are the datasets wanted, e.g. W-C0033-001; empty for all
+	Types []string `json:"types,omitempty"`
+
+	// Regions are the counties or county/township targets wanted; empty for all
+	Regions []string `json:"regions,omitempty"`
+
+	// MinLevel is the lowest rain grade wanted, e.g. 豪雨; empty for all
+	MinLevel string `json:"min_level,omitempty"`
+}
+
+// Event is the JSON body posted for one alert
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Region string    `json:"region"`
+	Level  string    `json:"level"`
+	Grade  int       `json:"grade"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+}
+
+// NewEvent describes alert raised at t
+func NewEvent(alert rain.Alert, t time.Time) Event {
+	return Event{
+		ID:     alert.ID(),
+		Type:   alert.Dataset,
+		Region: alert.Region,
+		Level:  alert.Level.String(),
+		Grade:  int(alert.Level),
+		Text:   alert.Text,
+		Time:   t,
+	}
+}
+
+// Wants reports whether the hook subscribes to dataset
+func (h Hook) Wants(dataset string) bool {
+	if len(h.Types) == 0 {
+		return true
+	}
+	for _, t := range h.Types {
+		if t == dataset {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter keeps the alerts at or above the minimum level of the hook
+func (h Hook) Filter(alerts []rain.Alert) []rain.Alert {
+	min, ok := rain.ParseLevel(h.MinLevel)
+	if !ok {
+		return alerts
+	}
+
+	var kept []rain.Alert
+	for _, alert := range alerts {
+		if alert.Level >= min {
+			kept = append(kept, alert)
+		}
+	}
+	return kept
+}
+
+// Sign is the signature of body posted at timestamp, sent as "sha256=<hex>"
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature made by Sign, for receivers
+func Verify(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body)))
+}
+
+func hookKey(id string) string {
+	return "hook:" + id
+}
+
+// Save validates and stores h; without a secret it keeps the one of the stored hook,
+// or generates one for a new hook
+func Save(c redis.Conn, h Hook) (Hook, error) {
+	if !hookID.MatchString(h.ID) {
+		return h, ErrID
+	}
+	if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return h, ErrURL
+	}
+	if h.Secret == "" {
+		stored, ok, err := Load(c, h.ID)
+		if err != nil {
+			return h, err
+		}
+		if ok {
+			h.Secret = stored.Secret
+		}
+	}
+	if h.Secret == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		h.Secret = hex.EncodeToString(b)
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return h, err
+	}
+
+	c.Send("MULTI")
+	c.Send("SADD", "hooks", h.ID)
+	c.Send("SET", hookKey(h.ID), data)
+	_, err = c.Do("EXEC")
+	return h, err
+}
+
+// Delete removes the hook id and its history
+func Delete(c redis.Conn, id string) error {
+	c.Send("MULTI")
+	c.Send("SREM", "hooks", id)
+	c.Send("DEL", hookKey(id), historyKey(id))
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Load reads the hook id, reporting false when it does not exist
+func Load(c redis.Conn, id string) (Hook, bool, error) {
+	data, err := redis.Bytes(c.Do("GET", hookKey(id)))
+	if err == redis.ErrNil {
+		return Hook{}, false, nil
+	}
+	if err != nil {
+		return Hook{}, false, err
+	}
+
+	var h Hook
+	if err := json.Unmarshal(data, &h); err != nil {
+		return Hook{}, false, err
+	}
+	return h, true, nil
+}
+
+// LoadAll reads every hook, sorted by ID
+func LoadAll(c redis.Conn) ([]Hook, error) {
+	ids, err := redis.Strings(c.Do("SMEMBERS", "hooks"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	var list []Hook
+	for _, id := range ids {
+		h, ok, loadErr := Load(c, id)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		if ok {
+			list = append(list, h)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,350 @@
+package hooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is an in-memory Redis with the commands used by the package;
+// EVALSHA runs takeScript
+type fakeConn struct {
+	strings map[string]string
+	sets    map[string]map[string]bool
+	zsets   map[string]map[string]float64
+	lists   map[string][]string
+	queued  [][]interface{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		strings: map[string]string{},
+		sets:    map[string]map[string]bool{},
+		zsets:   map[string]map[string]float64{},
+		lists:   map[string][]string{},
+	}
+}
+
+func (c *fakeConn) Close() error                  { return nil }
+func (c *fakeConn) Err() error                    { return nil }
+func (c *fakeConn) Flush() error                  { return nil }
+func (c *fakeConn) Receive() (interface{}, error) { return nil, nil }
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	c.queued = append(c.queued, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "EXEC" {
+		var replies []interface{}
+		for _, q := range c.queued {
+			if q[0] == "MULTI" {
+				continue
+			}
+			reply, err := c.do(q[0].(string), q[1:]...)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+		c.queued = nil
+		return replies, nil
+	}
+	return c.do(cmd, args...)
+}
+
+func (c *fakeConn) do(cmd string, args ...interface{}) (interface{}, error) {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case []byte:
+			s[i] = string(v)
+		default:
+			s[i] = fmt.Sprint(v)
+		}
+	}
+
+	switch cmd {
+	case "GET":
+		if v, ok := c.strings[s[0]]; ok {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "SET":
+		c.strings[s[0]] = s[1]
+		return "OK", nil
+	case "SADD":
+		if c.sets[s[0]] == nil {
+			c.sets[s[0]] = map[string]bool{}
+		}
+		c.sets[s[0]][s[1]] = true
+		return int64(1), nil
+	case "ZADD":
+		if c.zsets[s[0]] == nil {
+			c.zsets[s[0]] = map[string]float64{}
+		}
+		score, _ := strconv.ParseFloat(s[1], 64)
+		c.zsets[s[0]][s[2]] = score
+		return int64(1), nil
+	case "ZREM":
+		delete(c.zsets[s[0]], s[1])
+		return int64(1), nil
+	case "ZRANGEBYSCORE":
+		max, _ := strconv.ParseFloat(s[2], 64)
+		var members []string
+		for member, score := range c.zsets[s[0]] {
+			if score <= max {
+				members = append(members, member)
+			}
+		}
+		sort.Strings(members)
+		var reply []interface{}
+		for _, member := range members {
+			reply = append(reply, []byte(member))
+		}
+		return reply, nil
+	case "EVALSHA":
+		// takeScript: KEYS[1] = s[2], ARGV = s[3:]
+		score, ok := c.zsets[s[2]][s[3]]
+		now, _ := strconv.ParseFloat(s[4], 64)
+		if !ok || score > now {
+			return int64(0), nil
+		}
+		inflight, _ := strconv.ParseFloat(s[5], 64)
+		c.zsets[s[2]][s[3]] = now + inflight
+		return int64(1), nil
+	case "LPUSH":
+		c.lists[s[0]] = append([]string{s[1]}, c.lists[s[0]]...)
+		return int64(len(c.lists[s[0]])), nil
+	case "LTRIM":
+		stop, _ := strconv.Atoi(s[2])
+		if stop+1 < len(c.lists[s[0]]) {
+			c.lists[s[0]] = c.lists[s[0]][:stop+1]
+		}
+		return "OK", nil
+	case "LRANGE":
+		var reply []interface{}
+		for _, v := range c.lists[s[0]] {
+			reply = append(reply, []byte(v))
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("fakeConn: unsupported command %s", cmd)
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"a"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1496390400." + `{"id":"a"}`))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := Sign("secret", "1496390400", body); got != signature {
+		t.Fatalf("Sign = %s, want %s", got, signature)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      bool
+	}{
+		{"valid", "secret", "1496390400", `{"id":"a"}`, true},
+		{"other secret", "other", "1496390400", `{"id":"a"}`, false},
+		{"other timestamp", "secret", "1496390401", `{"id":"a"}`, false},
+		{"tampered body", "secret", "1496390400", `{"id":"b"}`, false},
+	}
+	for _, tt := range tests {
+		if got := Verify(tt.secret, tt.timestamp, []byte(tt.body), signature); got != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// receiver is a hook endpoint answering with the statuses in turn, then 200
+type receiver struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	statuses []int
+	requests int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	timestamp := req.Header.Get("X-Hook-Timestamp")
+	if !Verify(r.secret, timestamp, body, req.Header.Get("X-Hook-Signature")) {
+		r.t.Errorf("bad signature %q for timestamp %q", req.Header.Get("X-Hook-Signature"), timestamp)
+	}
+	if req.Header.Get("X-Hook-Delivery") == "" {
+		r.t.Error("no X-Hook-Delivery")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := http.StatusOK
+	if r.requests < len(r.statuses) {
+		status = r.statuses[r.requests]
+	}
+	r.requests++
+	w.WriteHeader(status)
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+func TestProcess(t *testing.T) {
+	always500 := make([]int, MaxAttempts)
+	for i := range always500 {
+		always500[i] = http.StatusInternalServerError
+	}
+
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		want     []Record // history, newest first
+	}{
+		{"delivered", nil, 1, []Record{
+			{Attempt: 1, Status: 200, Final: true},
+		}},
+		{"retried after 500", []int{500}, 2, []Record{
+			{Attempt: 2, Status: 200, Final: true},
+			{Attempt: 1, Status: 500},
+		}},
+		{"given up", always500, MaxAttempts, []Record{
+			{Attempt: 6, Status: 500, Final: true},
+			{Attempt: 5, Status: 500},
+			{Attempt: 4, Status: 500},
+			{Attempt: 3, Status: 500},
+			{Attempt: 2, Status: 500},
+			{Attempt: 1, Status: 500},
+		}},
+	}
+
+	for _, tt := range tests {
+		r := &receiver{t: t, secret: "secret", statuses: tt.statuses}
+		server := httptest.NewServer(r)
+
+		c := newFakeConn()
+		if _, err := Save(c, Hook{ID: "test", URL: server.URL, Secret: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := Enqueue(c, "test", Event{ID: "e1", Type: "O-A0002-001", Region: "新竹市"}); err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now()
+		for attempt := 1; attempt <= MaxAttempts+1; attempt++ {
+			if err := Process(context.Background(), c, now); err != nil {
+				t.Fatal(err)
+			}
+			if attempt < MaxAttempts {
+				// not due again before its backoff
+				if err := Process(context.Background(), c, now.Add(Backoff(attempt)-time.Second)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			now = now.Add(Backoff(attempt))
+		}
+		server.Close()
+
+		if got := r.count(); got != tt.requests {
+			t.Errorf("%s: %d requests, want %d", tt.name, got, tt.requests)
+		}
+		if n := len(c.zsets[pendingKey]); n != 0 {
+			t.Errorf("%s: %d deliveries still pending", tt.name, n)
+		}
+
+		history, err := History(c, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != len(tt.want) {
+			t.Errorf("%s: %d history records, want %d", tt.name, len(history), len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			got := history[i]
+			if got.Attempt != want.Attempt || got.Status != want.Status || got.Final != want.Final || got.Event != "e1" {
+				t.Errorf("%s: history[%d] = %+v, want %+v", tt.name, i, got, want)
+			}
+			if (got.Error == "") != (want.Status == 200) {
+				t.Errorf("%s: history[%d] error %q", tt.name, i, got.Error)
+			}
+		}
+	}
+}
+
+func TestProcessRequeuesInflight(t *testing.T) {
+	r := &receiver{t: t, secret: "secret"}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	c := newFakeConn()
+	if _, err := Save(c, Hook{ID: "test", URL: server.URL, Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Enqueue(c, "test", Event{ID: "e1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a worker takes the delivery and stops before attempting it
+	now := time.Now()
+	for data := range c.zsets[pendingKey] {
+		if _, err := takeScript.Do(c, pendingKey, data, now.Unix(), int64(inflightTimeout/time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		at       time.Time
+		requests int
+	}{
+		{now, 0},
+		{now.Add(inflightTimeout - time.Second), 0},
+		{now.Add(inflightTimeout), 1},
+		{now.Add(2 * inflightTimeout), 1},
+	}
+	for _, tt := range tests {
+		if err := Process(context.Background(), c, tt.at); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.count(); got != tt.requests {
+			t.Errorf("after Process at +%v: %d requests, want %d", tt.at.Sub(now), got, tt.requests)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level of a log entry
+type Level int
+
+// Level constants
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the name of the level
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return ""
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name such as "warn"
+func ParseLevel(name string) (Level, bool) {
+	for i, levelName := range levelNames {
+		if levelName == strings.ToLower(name) {
+			return Level(i), true
+		}
+	}
+	return LevelInfo, false
+}
+
+// Fields are the structured context of a log entry
+type Fields map[string]interface{}
+
+var (
+	mu       sync.Mutex
+	out      io.Writer = os.Stderr
+	minLevel           = LevelInfo
+)
+
+func init() {
+	if level, ok := ParseLevel(os.Getenv("LOG_LEVEL")); ok {
+		minLevel = level
+	}
+}
+
+// Logger writes JSON lines carrying its fields
+type Logger struct {
+	fields Fields
+}
+
+// Std is the logger without context
+var Std = &Logger{fields: Fields{}}
+
+// With returns a logger that adds fields to every entry
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{fields: merged}
+}
+
+// Debug logs msg at debug level
+func (l *Logger) Debug(msg string, fields ...Fields) {
+	l.log(LevelDebug, msg, fields)
+}
+
+// Info logs msg at info level
+func (l *Logger) Info(msg string, fields ...Fields) {
+	l.log(LevelInfo, msg, fields)
+}
+
+// Warn logs msg at warn level
+func (l *Logger) Warn(msg string, fields ...Fields) {
+	l.log(LevelWarn, msg, fields)
+}
+
+// Error logs msg and err at error level
+func (l *Logger) Error(msg string, err error, fields ...Fields) {
+	if err != nil {
+		fields = append(fields, Fields{"error": err.Error()})
+	}
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, extra []Fields) {
+	if level < minLevel {
+		return
+	}
+
+	entry := Fields{}
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for _, fields := range extra {
+		for k, v := range fields {
+			entry[k] = v
+		}
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(Fields{"level": "error", "msg": "logger: " + err.Error()})
+	}
+
+	mu.Lock()
+	out.Write(append(data, '\n'))
+	mu.Unlock()
+}
+
+// NewID returns a random correlation ID
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// HashID hides a LINE user, group or room ID behind a short hash
+func HashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:6])
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger of ctx, or Std
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return Std
+}
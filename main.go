@@ -13,318 +13,501 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/metrics"
+	"github.com/lancetw/hcfd-forecast-v1/postback"
 	"github.com/lancetw/hcfd-forecast-v1/rain"
+	"github.com/lancetw/hcfd-forecast-v1/subscriber"
 	"github.com/line/line-bot-sdk-go/linebot"
 )
 
 const timeZone = "Asia/Taipei"
 
+// defaultShutdownTimeout leaves a margin within the 30 seconds Heroku waits after SIGTERM
+const defaultShutdownTimeout = 25 * time.Second
+
 var bot *linebot.Client
+var dispatcher *postback.Dispatcher
+
+var webhookEvents = metrics.NewCounter(
+	"webhook_events_total",
+	"LINE webhook events received, by event type and command.",
+	"type", "command")
+
+var webhookIgnored = metrics.NewCounter(
+	"webhook_ignored_total",
+	"LINE webhook events left unanswered, by event type.",
+	"type")
+
+// commands are the bot commands counted by name in webhookEvents
+var commands = map[string]bool{
+	"加入": true, "退出": true, "設定": true, "安靜": true, "等級": true, "簡報": true, "區域": true, "通知": true,
+	"服務": true, "狀態": true, "時間": true, "雨量": true, "警報": true,
+	"重開": true, "清除": true, "貓圖": true, "妹子": true,
+}
+
+// commandLabel bounds the command label to the known commands
+func commandLabel(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) > 0 && commands[fields[0]] {
+		return fields[0]
+	}
+	return "other"
+}
 
 func main() {
 	var err error
 	bot, err = linebot.New(os.Getenv("CHANNEL_SECRET"), os.Getenv("ACCESS_TOKEN"))
 	if err != nil {
-		log.Println("Bot:", bot, " err:", err)
+		logger.Std.Error("Bot init error", err)
 		return
 	}
 
+	secret := os.Getenv("POSTBACK_SECRET")
+	if secret == "" {
+		secret = os.Getenv("CHANNEL_SECRET")
+	}
+	dispatcher = postback.NewDispatcher(secret, 10*time.Minute)
+	registerPostbacks(dispatcher)
+
+	rain.SetCache(db.DatasetCache{URL: os.Getenv("REDISTOGO_URL")}, false)
+	queue = newEventQueue(webhookWorkers())
+	go hub.run()
+
 	http.HandleFunc("/", homeHandler)
 	http.HandleFunc("/callback", callbackHandler)
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/cap", capHandler)
+	http.HandleFunc("/stream", streamHandler)
+	http.HandleFunc("/feeds/", feedHandler)
+	http.Handle("/api/v1/rain", apiHandler("rain", rainEndpoint))
+	http.Handle("/api/v1/warnings", apiHandler("warnings", warningsEndpoint))
+	http.Handle("/api/v1/stations", apiHandler("stations", stationsEndpoint))
+	http.HandleFunc("/admin/areas", areasHandler)
+	http.HandleFunc("/admin/hooks", hooksHandler)
+	http.HandleFunc("/admin/hooks/history", hookHistoryHandler)
+	http.HandleFunc("/admin/hooks/test", hookTestHandler)
 
 	port := os.Getenv("PORT")
 	addr := fmt.Sprintf(":%s", port)
-	http.ListenAndServe(addr, nil)
-}
+	server := &http.Server{Addr: addr}
 
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, "HCFD world")
-}
+	idle := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+
+		timeout := defaultShutdownTimeout
+		if d, parseErr := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); parseErr == nil {
+			timeout = d
+		}
 
-func callbackHandler(w http.ResponseWriter, r *http.Request) {
-	events, parseRequestErr := bot.ParseRequest(r)
-	if parseRequestErr != nil {
-		if parseRequestErr == linebot.ErrInvalidSignature {
-			w.WriteHeader(400)
-		} else {
-			w.WriteHeader(500)
+		logger.Std.Info("Shutting down", logger.Fields{"signal": sig.String()})
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		close(closing)
+		if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+			logger.Std.Error("Shutdown error", shutdownErr)
 		}
+		if stopErr := queue.stop(ctx); stopErr != nil {
+			logger.Std.Error("Webhook queue not drained", stopErr)
+		}
+		close(idle)
+	}()
+
+	if listenErr := server.ListenAndServe(); listenErr != http.ErrServerClosed {
+		logger.Std.Error("ListenAndServe error", listenErr)
 		return
 	}
+	<-idle
+}
 
-	for _, event := range events {
-		replyToken := event.ReplyToken
-		switch event.Type {
-		case linebot.EventTypeFollow:
-			profile, getProfileErr := bot.GetProfile(event.Source.UserID).Do()
-			if getProfileErr != nil {
-				bot.ReplyMessage(replyToken, linebot.NewTextMessage(getProfileErr.Error()))
-				log.Println(getProfileErr)
-			}
-			text := profile.DisplayName + " 您好，目前可用指令為：「加入」「退出」「雨量」「警報」「貓圖」「狀態」「時間」"
-			if _, replyErr := bot.ReplyMessage(
-				replyToken,
-				linebot.NewTextMessage(text)).Do(); replyErr != nil {
-				log.Println(replyErr)
+// handleEvent processes one webhook event
+func handleEvent(ctx context.Context, event *linebot.Event) {
+	lg := logger.FromContext(ctx)
+
+	replyToken := event.ReplyToken
+	switch event.Type {
+	case linebot.EventTypeFollow:
+		profile, getProfileErr := bot.GetProfile(event.Source.UserID).Do()
+		if getProfileErr != nil {
+			bot.ReplyMessage(replyToken, linebot.NewTextMessage(getProfileErr.Error()))
+			lg.Error("GetProfile error", getProfileErr)
+		}
+		text := profile.DisplayName + " 您好，目前可用指令為：「加入」「退出」「設定」「安靜」「等級」「簡報」「區域」「通知」「雨量」「警報」「貓圖」「狀態」「時間」"
+
+		c := db.Connect(os.Getenv("REDISTOGO_URL"))
+		restored, restoreErr := subscriber.Restore(c, event.Source.UserID)
+		if restoreErr != nil {
+			lg.Error("Restore preferences error", restoreErr)
+		}
+		if !restored {
+			if recordErr := subscriber.Record(c, subscriber.Follow); recordErr != nil {
+				lg.Error("Record churn error", recordErr)
 			}
-		case linebot.EventTypeMessage:
-			switch message := event.Message.(type) {
-			case *linebot.TextMessage:
-				profile, getProfileErr := bot.GetProfile(event.Source.UserID).Do()
-				if getProfileErr != nil {
-					bot.ReplyMessage(replyToken, linebot.NewTextMessage(getProfileErr.Error()))
-					log.Println(getProfileErr)
-				}
+		}
+		c.Close()
 
-				cmd := strings.Fields(message.Text)
+		if restored {
+			text = profile.DisplayName + " 歡迎回來，已恢復您先前的設定 ^＿^"
+		}
+		if _, replyErr := bot.ReplyMessage(
+			replyToken,
+			linebot.NewTextMessage(text)).Do(); replyErr != nil {
+			lg.Error("ReplyMessage error", replyErr)
+		}
+	case linebot.EventTypeUnfollow, linebot.EventTypeLeave:
+		reason := subscriber.Unfollow
+		if event.Type == linebot.EventTypeLeave {
+			reason = subscriber.Leave
+		}
 
-				switch cmd[0] {
-				case "加入":
-					c := db.Connect(os.Getenv("REDISTOGO_URL"))
-					status, addErr := c.Do("SADD", "user", event.Source.UserID)
-					defer c.Close()
-					if addErr != nil {
-						log.Println("SADD to redis error", addErr, status)
-					} else {
-						text := profile.DisplayName + " 您好，已將您加入傳送對象，未來將會傳送天氣警報資訊給您 ^＿^ "
-						if _, replyErr := bot.ReplyMessage(
-							replyToken,
-							linebot.NewTextMessage(text)).Do(); replyErr != nil {
-							log.Println(replyErr)
-						}
-					}
-				case "退出":
-					c := db.Connect(os.Getenv("REDISTOGO_URL"))
-					status, setErr := c.Do("SREM", "user", event.Source.UserID)
-					defer c.Close()
+		c := db.Connect(os.Getenv("REDISTOGO_URL"))
+		if removeErr := subscriber.Remove(c, subscriber.ID(event.Source), reason, subscriber.Window()); removeErr != nil {
+			lg.Error("Remove subscriber error", removeErr)
+		}
+		c.Close()
+	case linebot.EventTypeJoin:
+		c := db.Connect(os.Getenv("REDISTOGO_URL"))
+		if _, restoreErr := subscriber.Restore(c, subscriber.ID(event.Source)); restoreErr != nil {
+			lg.Error("Restore preferences error", restoreErr)
+		}
+		if recordErr := subscriber.Record(c, subscriber.Join); recordErr != nil {
+			lg.Error("Record churn error", recordErr)
+		}
+		c.Close()
 
-					if setErr != nil {
-						log.Println("DEL to redis error", setErr, status)
-					} else {
-						text := profile.DisplayName + " 掰掰 Q＿Q"
-						if _, replyErr := bot.ReplyMessage(
-							replyToken,
-							linebot.NewTextMessage(text)).Do(); replyErr != nil {
-							log.Println(replyErr)
-						}
-					}
-				case "服務":
-					c := db.Connect(os.Getenv("REDISTOGO_URL"))
-					count, countErr := redis.Int(c.Do("SCARD", "user"))
-					defer c.Close()
+		text := "大家好，目前可用指令為：「加入」「退出」「設定」「安靜」「等級」「簡報」「區域」「通知」「雨量」「警報」「狀態」「時間」"
+		if _, replyErr := bot.ReplyMessage(
+			replyToken,
+			linebot.NewTextMessage(text)).Do(); replyErr != nil {
+			lg.Error("ReplyMessage error", replyErr)
+		}
+	case linebot.EventTypePostback:
+		postbackHandler(ctx, event)
+	case linebot.EventTypeMessage:
+		switch message := event.Message.(type) {
+		case *linebot.TextMessage:
+			cmd := strings.Fields(message.Text)
+			if len(cmd) == 0 {
+				if _, replyErr := bot.ReplyMessage(
+					replyToken,
+					linebot.NewTextMessage("指令錯誤，請重試")).Do(); replyErr != nil {
+					lg.Error("ReplyMessage error", replyErr)
+				}
+				return
+			}
 
-					if countErr != nil {
-						log.Println(countErr)
-					} else {
-						text := fmt.Sprintf("目前有 %d 人加入自動警訊服務。", count)
-						if _, replyErr := bot.ReplyMessage(
-							replyToken,
-							linebot.NewTextMessage(text)).Do(); replyErr != nil {
-							log.Println(replyErr)
-						}
-					}
-				case "狀態":
-					c := db.Connect(os.Getenv("REDISTOGO_URL"))
-					status, getErr := redis.Int(c.Do("SISMEMBER", "user", event.Source.UserID))
+			profile, getProfileErr := bot.GetProfile(event.Source.UserID).Do()
+			if getProfileErr != nil {
+				bot.ReplyMessage(replyToken, linebot.NewTextMessage(getProfileErr.Error()))
+				lg.Error("GetProfile error", getProfileErr)
+			}
 
-					var text string
-					if getErr != nil || status == 0 {
-						text = "目前沒有登記您的編號喔！"
-					} else {
-						text = "您已經是傳送對象 :D"
+			switch cmd[0] {
+			case "加入":
+				c := db.Connect(os.Getenv("REDISTOGO_URL"))
+				status, addErr := c.Do("SADD", "user", subscriber.ID(event.Source))
+				defer c.Close()
+				if addErr != nil {
+					lg.Error("SADD to redis error", addErr, logger.Fields{"status": status})
+				} else {
+					text := profile.DisplayName + " 您好，已將您加入傳送對象，未來將會傳送天氣警報資訊給您 ^＿^ "
+					if _, replyErr := bot.ReplyMessage(
+						replyToken,
+						linebot.NewTextMessage(text)).Do(); replyErr != nil {
+						lg.Error("ReplyMessage error", replyErr)
 					}
-
-					defer c.Close()
-
+				}
+			case "退出":
+				c := db.Connect(os.Getenv("REDISTOGO_URL"))
+				status, setErr := c.Do("SREM", "user", subscriber.ID(event.Source))
+				defer c.Close()
+
+				if setErr != nil {
+					lg.Error("SREM to redis error", setErr, logger.Fields{"status": status})
+				} else {
+					text := profile.DisplayName + " 掰掰 Q＿Q"
 					if _, replyErr := bot.ReplyMessage(
 						replyToken,
 						linebot.NewTextMessage(text)).Do(); replyErr != nil {
-						log.Println(replyErr)
+						lg.Error("ReplyMessage error", replyErr)
 					}
-
-				case "時間":
-					local := time.Now()
-					location, timezoneErr := time.LoadLocation(timeZone)
-					if timezoneErr == nil {
-						local = local.In(location)
+				}
+			case "服務":
+				c := db.Connect(os.Getenv("REDISTOGO_URL"))
+				count, countErr := redis.Int(c.Do("SCARD", "user"))
+				defer c.Close()
+
+				if countErr != nil {
+					lg.Error("SCARD redis error", countErr)
+				} else {
+					text := fmt.Sprintf("目前有 %d 人加入自動警訊服務。", count)
+					if churn, churnErr := subscriber.Churn(c, 30); churnErr == nil {
+						text = text + fmt.Sprintf("\n近 30 天：新增 %d、封鎖 %d、回鍋 %d", churn[subscriber.Follow], churn[subscriber.Unfollow], churn[subscriber.Restored])
 					}
-
-					text := local.Format("2006/01/02 15:04:05")
 					if _, replyErr := bot.ReplyMessage(
 						replyToken,
 						linebot.NewTextMessage(text)).Do(); replyErr != nil {
-						log.Println(replyErr)
+						lg.Error("ReplyMessage error", replyErr)
 					}
-
-				case "雨量":
-					target := []string{"新竹市"}
-					if len(cmd) > 1 {
-						target[0] = cmd[1]
+				}
+			case "狀態":
+				c := db.Connect(os.Getenv("REDISTOGO_URL"))
+				status, getErr := redis.Int(c.Do("SISMEMBER", "user", subscriber.ID(event.Source)))
+
+				var text string
+				if getErr != nil || status == 0 {
+					text = "目前沒有登記您的編號喔！"
+				} else {
+					text = "您已經是傳送對象 :D"
+					if pref, loadErr := subscriber.Load(c, subscriber.ID(event.Source)); loadErr == nil {
+						text = text + "\n" + preferencesText(pref)
 					}
+				}
+
+				defer c.Close()
+
+				if _, replyErr := bot.ReplyMessage(
+					replyToken,
+					linebot.NewTextMessage(text)).Do(); replyErr != nil {
+					lg.Error("ReplyMessage error", replyErr)
+				}
+
+			case "時間":
+				local := time.Now()
+				location, timezoneErr := time.LoadLocation(timeZone)
+				if timezoneErr == nil {
+					local = local.In(location)
+				}
+
+				text := local.Format("2006/01/02 15:04:05")
+				if _, replyErr := bot.ReplyMessage(
+					replyToken,
+					linebot.NewTextMessage(text)).Do(); replyErr != nil {
+					lg.Error("ReplyMessage error", replyErr)
+				}
+
+			case "設定":
+				settingsCommand(ctx, replyToken, cmd)
+
+			case "安靜":
+				quietCommand(ctx, event, cmd)
 
-					msgs, _ := rain.GetRainingInfo(target, true)
+			case "等級":
+				floorCommand(ctx, event, cmd)
 
-					local := time.Now()
-					location, timezoneErr := time.LoadLocation(timeZone)
-					if timezoneErr == nil {
-						local = local.In(location)
+			case "簡報":
+				briefingCommand(ctx, event, cmd)
+
+			case "區域":
+				areaCommand(ctx, event, cmd)
+
+			case "通知":
+				channelCommand(ctx, event, cmd)
+
+			case "雨量":
+				target := []string{"新竹市"}
+				var msgs []string
+				found := false
+				locations, _, fetchErr := rain.FetchRaining(ctx)
+				if fetchErr != nil {
+					lg.Error("FetchRaining error", fetchErr)
+				}
+				if len(cmd) > 1 {
+					target[0] = cmd[1]
+					msgs, found = rain.StationInfo(locations, cmd[1])
+				} else {
+					c := db.Connect(os.Getenv("REDISTOGO_URL"))
+					region, getErr := redis.String(c.Do("HGET", "pref:"+subscriber.ID(event.Source), "region"))
+					if getErr == nil && region != "" {
+						target[0] = region
 					}
-					now := local.Format("15:04:05")
+					c.Close()
+				}
 
-					var text string
-					if len(msgs) == 0 {
-						text = "目前沒有雨量資訊！"
+				if !found {
+					msgs = rain.RainingInfo(locations, target, true)
+				}
+
+				local := time.Now()
+				location, timezoneErr := time.LoadLocation(timeZone)
+				if timezoneErr == nil {
+					local = local.In(location)
+				}
+				now := local.Format("15:04:05")
+
+				var text string
+				if len(msgs) == 0 {
+					text = "目前沒有雨量資訊！"
+					if _, replyErr := bot.ReplyMessage(
+						replyToken,
+						linebot.NewTextMessage(text)).Do(); replyErr != nil {
+						lg.Error("ReplyMessage error", replyErr)
+					}
+				} else {
+					if len(msgs) > 0 {
+						for _, msg := range msgs {
+							text = text + msg + "\n\n"
+						}
+						text = strings.TrimSpace(text)
+						text = text + "\n\n" + now
 						if _, replyErr := bot.ReplyMessage(
 							replyToken,
 							linebot.NewTextMessage(text)).Do(); replyErr != nil {
-							log.Println(replyErr)
-						}
-					} else {
-						if len(msgs) > 0 {
-							for _, msg := range msgs {
-								text = text + msg + "\n\n"
-							}
-							text = strings.TrimSpace(text)
-							text = text + "\n\n" + now
-							if _, replyErr := bot.ReplyMessage(
-								replyToken,
-								linebot.NewTextMessage(text)).Do(); replyErr != nil {
-								log.Println(replyErr)
-							}
+							lg.Error("ReplyMessage error", replyErr)
 						}
 					}
+				}
 
-				case "警報":
-					msgs, _ := rain.GetWarningInfo(nil)
+			case "警報":
+				msgs, _ := rain.GetWarningInfo(ctx, nil)
 
-					local := time.Now()
-					location, timezoneErr := time.LoadLocation(timeZone)
-					if timezoneErr == nil {
-						local = local.In(location)
+				local := time.Now()
+				location, timezoneErr := time.LoadLocation(timeZone)
+				if timezoneErr == nil {
+					local = local.In(location)
+				}
+				now := local.Format("15:04:05")
+				var text string
+				if len(msgs) <= 0 {
+					text = "目前沒有天氣警報資訊！"
+					if _, replyErr := bot.ReplyMessage(
+						replyToken,
+						linebot.NewTextMessage(text)).Do(); replyErr != nil {
+						lg.Error("ReplyMessage error", replyErr)
 					}
-					now := local.Format("15:04:05")
-					var text string
-					if len(msgs) <= 0 {
-						text = "目前沒有天氣警報資訊！"
+				} else {
+					if len(msgs) > 0 {
+						for _, msg := range msgs {
+							text = text + msg + "\n\n"
+						}
+						text = strings.TrimSpace(text)
+						text = text + "\n\n" + now
 						if _, replyErr := bot.ReplyMessage(
 							replyToken,
 							linebot.NewTextMessage(text)).Do(); replyErr != nil {
-							log.Println(replyErr)
-						}
-					} else {
-						if len(msgs) > 0 {
-							for _, msg := range msgs {
-								text = text + msg + "\n\n"
-							}
-							text = strings.TrimSpace(text)
-							text = text + "\n\n" + now
-							if _, replyErr := bot.ReplyMessage(
-								replyToken,
-								linebot.NewTextMessage(text)).Do(); replyErr != nil {
-								log.Println(replyErr)
-							}
+							lg.Error("ReplyMessage error", replyErr)
 						}
 					}
+				}
 
-				case "重開":
-					c := db.Connect(os.Getenv("REDISTOGO_URL"))
-					status0, clearErr0 := c.Do("DEL", "token0")
-					if clearErr0 != nil {
-						log.Println("DEL to redis error", clearErr0, status0)
-					}
-					status1, clearErr1 := c.Do("DEL", "token1")
-					if clearErr1 != nil {
-						log.Println("DEL to redis error", clearErr1, status1)
-					}
+			case "重開":
+				c := db.Connect(os.Getenv("REDISTOGO_URL"))
+				status0, clearErr0 := c.Do("DEL", "token0")
+				if clearErr0 != nil {
+					lg.Error("DEL to redis error", clearErr0, logger.Fields{"status": status0})
+				}
+				status1, clearErr1 := c.Do("DEL", "token1")
+				if clearErr1 != nil {
+					lg.Error("DEL to redis error", clearErr1, logger.Fields{"status": status1})
+				}
+				status2, clearErr2 := c.Do("DEL", "token2")
+				if clearErr2 != nil {
+					lg.Error("DEL to redis error", clearErr2, logger.Fields{"status": status2})
+				}
 
-					if _, replyErr := bot.ReplyMessage(
-						replyToken,
-						linebot.NewTextMessage("已重開")).Do(); replyErr != nil {
-						log.Println(replyErr)
-					}
+				if _, replyErr := bot.ReplyMessage(
+					replyToken,
+					linebot.NewTextMessage("已重開")).Do(); replyErr != nil {
+					lg.Error("ReplyMessage error", replyErr)
+				}
 
-				case "清除":
-					c := db.Connect(os.Getenv("REDISTOGO_URL"))
-					status0, clearErr0 := c.Do("DEL", "user")
-					if clearErr0 != nil {
-						log.Println("DEL to redis error", clearErr0, status0)
-					}
+			case "清除":
+				c := db.Connect(os.Getenv("REDISTOGO_URL"))
+				status0, clearErr0 := c.Do("DEL", "user")
+				if clearErr0 != nil {
+					lg.Error("DEL to redis error", clearErr0, logger.Fields{"status": status0})
+				}
 
+				if _, replyErr := bot.ReplyMessage(
+					replyToken,
+					linebot.NewTextMessage("已清除使用者")).Do(); replyErr != nil {
+					lg.Error("ReplyMessage error", replyErr)
+				}
+
+			case "貓圖":
+				image := "https://thecatapi.com/api/images/get?format=src&type=jpg&api_key=MTI5ODM2"
+				if image != "" {
 					if _, replyErr := bot.ReplyMessage(
 						replyToken,
-						linebot.NewTextMessage("已清除使用者")).Do(); replyErr != nil {
-						log.Println(replyErr)
+						linebot.NewImageMessage(image, image)).Do(); replyErr != nil {
+						lg.Error("ReplyMessage error", replyErr)
 					}
+				}
 
-				case "貓圖":
-					image := "https://thecatapi.com/api/images/get?format=src&type=jpg&api_key=MTI5ODM2"
-					if image != "" {
-						if _, replyErr := bot.ReplyMessage(
-							replyToken,
-							linebot.NewImageMessage(image, image)).Do(); replyErr != nil {
-							log.Println(replyErr)
-						}
-					}
+			case "妹子":
+				type MeisData struct {
+					ID         string `json:"id"`
+					Name       string `json:"name"`
+					ImgNo      string `json:"img_no"`
+					Fanpage    string `json:"fanpage"`
+					Creator    string `json:"creator"`
+					UpdateTime string `json:"update_time"`
+				}
 
-				case "妹子":
-					type MeisData struct {
-						ID         string `json:"id"`
-						Name       string `json:"name"`
-						ImgNo      string `json:"img_no"`
-						Fanpage    string `json:"fanpage"`
-						Creator    string `json:"creator"`
-						UpdateTime string `json:"update_time"`
-					}
+				type Beauty struct {
+					Meis map[string]MeisData `json:"meis"`
+				}
 
-					type Beauty struct {
-						Meis map[string]MeisData `json:"meis"`
-					}
+				beauty := new(Beauty)
+				getJSONErr := getJSON("http://beauty.zones.gamebase.com.tw/wall?json", &beauty)
+				if len(beauty.Meis) > 0 {
+					for fbid, data := range beauty.Meis {
+						image := fmt.Sprintf("https://graph.facebook.com/%s/picture?type=large", fbid)
+						if image != "" {
+							link := fmt.Sprintf("https://www.facebook.com/profile.php?id=%s", fbid)
+							description := fmt.Sprintf("%s %s", data.Name, link)
 
-					beauty := new(Beauty)
-					getJSONErr := getJSON("http://beauty.zones.gamebase.com.tw/wall?json", &beauty)
-					if len(beauty.Meis) > 0 {
-						for fbid, data := range beauty.Meis {
-							image := fmt.Sprintf("https://graph.facebook.com/%s/picture?type=large", fbid)
-							if image != "" {
-								link := fmt.Sprintf("https://www.facebook.com/profile.php?id=%s", fbid)
-								description := fmt.Sprintf("%s %s", data.Name, link)
-
-								if _, replyErr := bot.ReplyMessage(
-									replyToken,
-									linebot.NewImageMessage(image, image),
-									linebot.NewTextMessage(description)).Do(); replyErr != nil {
-									log.Println(replyErr)
-								}
+							if _, replyErr := bot.ReplyMessage(
+								replyToken,
+								linebot.NewImageMessage(image, image),
+								linebot.NewTextMessage(description)).Do(); replyErr != nil {
+								lg.Error("ReplyMessage error", replyErr)
 							}
-
-							break
 						}
-					}
 
-					if getJSONErr != nil {
-						log.Println(getJSONErr)
+						break
 					}
+				}
 
-				default:
-					if _, replyErr := bot.ReplyMessage(
-						replyToken,
-						linebot.NewTextMessage("指令錯誤，請重試")).Do(); replyErr != nil {
-						log.Println(replyErr)
-					}
+				if getJSONErr != nil {
+					lg.Error("getJSON error", getJSONErr)
+				}
+
+			default:
+				if _, replyErr := bot.ReplyMessage(
+					replyToken,
+					linebot.NewTextMessage("指令錯誤，請重試")).Do(); replyErr != nil {
+					lg.Error("ReplyMessage error", replyErr)
 				}
 			}
 		}
+	case linebot.EventTypeBeacon:
+		// no beacons are deployed for the bot, so their events are only counted
+		webhookIgnored.Inc(string(event.Type))
+		if event.Beacon != nil {
+			lg.Info("Beacon event ignored", logger.Fields{"hwid": event.Beacon.Hwid, "beacon": string(event.Beacon.Type)})
+		}
+	default:
+		webhookIgnored.Inc(string(event.Type))
+		lg.Info("Webhook event ignored")
 	}
 }
 
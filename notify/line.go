@@ -0,0 +1,36 @@
+package notify
+
+import (
+	"context"
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// lineTextLength is the limit of a LINE text message
+const lineTextLength = 2000
+
+// LINE pushes text messages to LINE user, group or room IDs
+type LINE struct {
+	Bot *linebot.Client
+}
+
+// Name of the channel
+func (LINE) Name() string {
+	return "line"
+}
+
+// Notify pushes m to the LINE ID to
+func (n LINE) Notify(ctx context.Context, to string, m Message) error {
+	_, err := n.Bot.PushMessage(to, linebot.NewTextMessage(FormatLINE(m))).WithContext(ctx).Do()
+	if apiErr, ok := err.(*linebot.APIError); ok {
+		return &StatusError{Code: apiErr.Code}
+	}
+	return err
+}
+
+// FormatLINE renders m as plain text within the LINE limit, the time last
+func FormatLINE(m Message) string {
+	end := stamp(m, "15:04:05")
+	return truncate(strings.TrimSpace(m.Text), lineTextLength-len([]rune(end))) + end
+}
@@ -0,0 +1,171 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrAddress is returned for an address a channel refuses to deliver to
+var ErrAddress = errors.New("notify: address not allowed")
+
+// Message is one alert text to deliver
+type Message struct {
+	Title string
+	Text  string
+	Time  time.Time
+}
+
+// Notifier delivers messages over one channel; to is the address on that channel,
+// such as a LINE ID, an email address or a chat ID
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, to string, m Message) error
+}
+
+// StatusError is a delivery rejected by the remote API with status Code
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("notify: status %d", e.Code)
+}
+
+// client is shared by the HTTP based channels; as subscribers choose the webhook URLs,
+// it only dials public addresses
+var client = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         dialPublic,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// privateNets are the loopback, private, link-local and other non public ranges
+var privateNets = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// public reports whether ip lies outside privateNets
+func public(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic resolves addr and dials it only when every address it resolves to is public,
+// so that a webhook cannot reach the metadata service or the internal network
+func dialPublic(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, ErrAddress
+	}
+	for _, ip := range ips {
+		if !public(ip.IP) {
+			return nil, ErrAddress
+		}
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+}
+
+// postJSON posts v to endpoint and fails on a non 2xx status
+func postJSON(ctx context.Context, endpoint string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req.WithContext(ctx))
+	if urlErr, ok := err.(*url.Error); ok && urlErr.Err == ErrAddress {
+		return ErrAddress
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &StatusError{Code: res.StatusCode}
+	}
+	return nil
+}
+
+// stamp renders the time of m with layout after a blank line, or nothing without a time
+func stamp(m Message, layout string) string {
+	if m.Time.IsZero() {
+		return ""
+	}
+	return "\n\n" + m.Time.Format(layout)
+}
+
+// truncate cuts text to n runes
+func truncate(text string, n int) string {
+	if r := []rune(text); len(r) > n {
+		return string(r[:n-3]) + "..."
+	}
+	return text
+}
+
+// Registry holds the configured notifiers by name
+type Registry map[string]Notifier
+
+// Add registers n under its name
+func (r Registry) Add(n Notifier) {
+	r[n.Name()] = n
+}
+
+// FromEnv registers the channels whose configuration is present in the environment
+func FromEnv() Registry {
+	r := Registry{}
+	if n, ok := WebhookFromEnv(); ok {
+		r.Add(n)
+	}
+	r.Add(SlackFromEnv())
+	if n, ok := SMTPFromEnv(); ok {
+		r.Add(n)
+	}
+	if n, ok := TelegramFromEnv(); ok {
+		r.Add(n)
+	}
+	return r
+}
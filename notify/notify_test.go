@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"203.66.1.1", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.20.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.1.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"2001:4860:4860::8888", true},
+	}
+	for _, tt := range tests {
+		if got := public(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("public(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	webhook := Webhook{Hosts: []string{"example.com"}}
+	mattermost := Slack{Hosts: []string{"chat.example.com"}}
+	tests := []struct {
+		name     string
+		notifier interface {
+			Allowed(string) bool
+		}
+		to   string
+		want bool
+	}{
+		{"slack", Slack{}, "https://hooks.slack.com/services/T0/B0/x", true},
+		{"slack elsewhere", Slack{}, "https://hooks.slack.com.evil.test/services", false},
+		{"slack metadata", Slack{}, "http://169.254.169.254/latest", false},
+		{"mattermost", mattermost, "https://chat.example.com/hooks/xxx", true},
+		{"mattermost keeps slack", mattermost, "https://hooks.slack.com/services/T0/B0/x", true},
+		{"mattermost http", mattermost, "http://chat.example.com/hooks/xxx", false},
+		{"mattermost other host", mattermost, "https://chat.example.org/hooks/xxx", false},
+		{"mattermost without hosts", Slack{}, "https://chat.example.com/hooks/xxx", false},
+		{"webhook host", webhook, "https://example.com/hook", true},
+		{"webhook host case", webhook, "https://EXAMPLE.com/hook", true},
+		{"webhook http", webhook, "http://example.com/hook", false},
+		{"webhook other host", webhook, "https://example.org/hook", false},
+		{"webhook userinfo", webhook, "https://example.com@127.0.0.1/hook", false},
+		{"webhook without hosts", Webhook{}, "https://example.com/hook", false},
+	}
+	for _, tt := range tests {
+		if got := tt.notifier.Allowed(tt.to); got != tt.want {
+			t.Errorf("%s: Allowed(%q) = %v, want %v", tt.name, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestPostJSONRefusesPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("private address dialed")
+	}))
+	defer server.Close()
+
+	if err := postJSON(context.Background(), server.URL, nil); err != ErrAddress {
+		t.Fatalf("postJSON = %v, want ErrAddress", err)
+	}
+}
@@ -0,0 +1,123 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// smtpTimeout bounds one mail when the context has no deadline
+const smtpTimeout = 30 * time.Second
+
+// SMTP sends alerts by email; SMTP_ADDR (host:port), SMTP_FROM, SMTP_USER and SMTP_PASSWORD configure it
+type SMTP struct {
+	Addr     string
+	From     string
+	User     string
+	Password string
+}
+
+// SMTPFromEnv reads the SMTP configuration, reporting false when SMTP_ADDR is unset
+func SMTPFromEnv() (SMTP, bool) {
+	n := SMTP{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		From:     os.Getenv("SMTP_FROM"),
+		User:     os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+	if n.From == "" {
+		n.From = n.User
+	}
+	return n, n.Addr != "" && n.From != ""
+}
+
+// Name of the channel
+func (SMTP) Name() string {
+	return "email"
+}
+
+// Notify mails m to the address to, giving up at the deadline of ctx or after smtpTimeout
+func (n SMTP) Notify(ctx context.Context, to string, m Message) error {
+	host, _, err := net.SplitHostPort(n.Addr)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, smtpTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	conn, err := dialPublic(ctx, "tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.User, n.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(FormatEmail(n.From, to, m)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// FormatEmail renders m as a UTF-8 plain text email
+func FormatEmail(from string, to string, m Message) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + mime.BEncoding.Encode("UTF-8", m.Title),
+		"Date: " + m.Time.Format("Mon, 02 Jan 2006 15:04:05 -0700"),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"Content-Transfer-Encoding: base64",
+	}
+
+	body := base64.StdEncoding.EncodeToString([]byte(strings.TrimSpace(m.Text) + stamp(m, "2006/01/02 15:04:05") + "\n"))
+	var lines []string
+	for len(body) > 76 {
+		lines = append(lines, body[:76])
+		body = body[76:]
+	}
+	lines = append(lines, body)
+
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.Join(lines, "\r\n") + "\r\n")
+}
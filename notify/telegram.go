@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// telegramAPI is the Bot API endpoint
+const telegramAPI = "https://api.telegram.org/bot"
+
+// telegramTextLength is the limit of a Telegram message
+const telegramTextLength = 4096
+
+// Telegram sends alerts through a Telegram bot; TELEGRAM_BOT_TOKEN configures it
+type Telegram struct {
+	Token string
+}
+
+// TelegramFromEnv reads the bot token, reporting false when TELEGRAM_BOT_TOKEN is unset
+func TelegramFromEnv() (Telegram, bool) {
+	n := Telegram{Token: os.Getenv("TELEGRAM_BOT_TOKEN")}
+	return n, n.Token != ""
+}
+
+// Name of the channel
+func (Telegram) Name() string {
+	return "telegram"
+}
+
+// Notify sends m to the chat ID to
+func (n Telegram) Notify(ctx context.Context, to string, m Message) error {
+	return postJSON(ctx, telegramAPI+n.Token+"/sendMessage", map[string]string{
+		"chat_id": to,
+		"text":    FormatTelegram(m),
+	})
+}
+
+// FormatTelegram renders m as plain text within the Telegram limit
+func FormatTelegram(m Message) string {
+	end := stamp(m, "15:04:05")
+	text := m.Title + "\n" + strings.TrimSpace(m.Text)
+	return truncate(text, telegramTextLength-len([]rune(end))) + end
+}
@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// slackPrefix starts every Slack incoming webhook URL
+const slackPrefix = "https://hooks.slack.com/"
+
+// Webhook posts alerts as JSON to the URL of the subscriber, on one of Hosts only
+type Webhook struct {
+	Hosts []string
+}
+
+// WebhookFromEnv reads NOTIFY_WEBHOOK_HOSTS, the comma separated hosts subscribers may
+// post to, reporting false when it is unset
+func WebhookFromEnv() (Webhook, bool) {
+	n := Webhook{Hosts: webhookHosts()}
+	return n, len(n.Hosts) > 0
+}
+
+func webhookHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(os.Getenv("NOTIFY_WEBHOOK_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Name of the channel
+func (Webhook) Name() string {
+	return "webhook"
+}
+
+// webhookPayload is the JSON body of a generic webhook
+type webhookPayload struct {
+	Title string    `json:"title"`
+	Text  string    `json:"text"`
+	Time  time.Time `json:"time"`
+}
+
+// Allowed reports whether to is an https URL on one of the hosts
+func (n Webhook) Allowed(to string) bool {
+	u, err := url.Parse(to)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	for _, host := range n.Hosts {
+		if strings.ToLower(u.Host) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify posts m to the URL to
+func (n Webhook) Notify(ctx context.Context, to string, m Message) error {
+	if !n.Allowed(to) {
+		return ErrAddress
+	}
+	return postJSON(ctx, to, webhookPayload{
+		Title: m.Title,
+		Text:  strings.TrimSpace(m.Text),
+		Time:  m.Time,
+	})
+}
+
+// Slack posts alerts to Slack incoming webhooks, or to the Slack-compatible ones
+// (e.g. Mattermost) on one of Hosts
+type Slack struct {
+	Hosts []string
+}
+
+// SlackFromEnv allows the hosts of NOTIFY_WEBHOOK_HOSTS besides Slack itself
+func SlackFromEnv() Slack {
+	return Slack{Hosts: webhookHosts()}
+}
+
+// Name of the channel
+func (Slack) Name() string {
+	return "slack"
+}
+
+// Allowed reports whether to is a Slack incoming webhook URL or an https URL on one of the hosts
+func (n Slack) Allowed(to string) bool {
+	return strings.HasPrefix(to, slackPrefix) || Webhook{Hosts: n.Hosts}.Allowed(to)
+}
+
+// Notify posts m to the incoming webhook URL to
+func (n Slack) Notify(ctx context.Context, to string, m Message) error {
+	if !n.Allowed(to) {
+		return ErrAddress
+	}
+	return postJSON(ctx, to, map[string]string{"text": FormatSlack(m)})
+}
+
+// FormatSlack renders m in Slack markup, the title in bold
+func FormatSlack(m Message) string {
+	escaper := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	text := "*" + escaper.Replace(m.Title) + "*\n" + escaper.Replace(strings.TrimSpace(m.Text))
+	if !m.Time.IsZero() {
+		text = text + "\n_" + m.Time.Format("15:04:05") + "_"
+	}
+	return text
+}
@@ -0,0 +1,149 @@
+package postback
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// maxDataLength is the LINE limit for postback data
+const maxDataLength = 300
+
+// sigLength is the number of base64 characters kept from the HMAC
+const sigLength = 16
+
+// errors
+var (
+	ErrMalformed        = errors.New("postback: malformed payload")
+	ErrInvalidSignature = errors.New("postback: invalid signature")
+	ErrExpired          = errors.New("postback: payload expired")
+	ErrTooLong          = errors.New("postback: payload too long")
+	ErrUnknownAction    = errors.New("postback: unknown action")
+)
+
+// Payload is the decoded content of a postback
+type Payload struct {
+	Action  string
+	Args    url.Values
+	Expires time.Time
+}
+
+// Encode packs action, args and expiry into "action|args|expiry|sig"
+func Encode(secret string, p Payload) (string, error) {
+	if p.Action == "" || strings.Contains(p.Action, "|") {
+		return "", ErrMalformed
+	}
+
+	body := p.Action + "|" + p.Args.Encode() + "|" + strconv.FormatInt(p.Expires.Unix(), 36)
+	data := body + "|" + sign(secret, body)
+	if len(data) > maxDataLength {
+		return "", ErrTooLong
+	}
+
+	return data, nil
+}
+
+// Decode verifies the signature and expiry of data and unpacks it
+func Decode(secret string, data string, now time.Time) (*Payload, error) {
+	i := strings.LastIndex(data, "|")
+	if i < 0 {
+		return nil, ErrMalformed
+	}
+	body, sig := data[:i], data[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(sign(secret, body))) {
+		return nil, ErrInvalidSignature
+	}
+
+	parts := strings.Split(body, "|")
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, ErrMalformed
+	}
+
+	args, parseErr := url.ParseQuery(parts[1])
+	if parseErr != nil {
+		return nil, ErrMalformed
+	}
+
+	expires, expiresErr := strconv.ParseInt(parts[2], 36, 64)
+	if expiresErr != nil {
+		return nil, ErrMalformed
+	}
+
+	p := &Payload{
+		Action:  parts[0],
+		Args:    args,
+		Expires: time.Unix(expires, 0),
+	}
+	if now.After(p.Expires) {
+		return p, ErrExpired
+	}
+
+	return p, nil
+}
+
+func sign(secret string, body string) string {
+	hash := hmac.New(sha256.New, []byte(secret))
+	hash.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))[:sigLength]
+}
+
+// Handler handles one postback action
+type Handler func(ctx context.Context, event *linebot.Event, p *Payload)
+
+// Dispatcher routes signed postbacks to the handler of their action
+type Dispatcher struct {
+	secret   string
+	ttl      time.Duration
+	handlers map[string]Handler
+}
+
+// NewDispatcher creates a dispatcher whose payloads live for ttl
+func NewDispatcher(secret string, ttl time.Duration) *Dispatcher {
+	return &Dispatcher{
+		secret:   secret,
+		ttl:      ttl,
+		handlers: map[string]Handler{},
+	}
+}
+
+// Handle registers h for action
+func (d *Dispatcher) Handle(action string, h Handler) {
+	d.handlers[action] = h
+}
+
+// Data encodes a payload for action that expires after the dispatcher ttl
+func (d *Dispatcher) Data(action string, args url.Values) (string, error) {
+	return Encode(d.secret, Payload{
+		Action:  action,
+		Args:    args,
+		Expires: time.Now().Add(d.ttl),
+	})
+}
+
+// Dispatch decodes the postback of event and calls its handler
+func (d *Dispatcher) Dispatch(ctx context.Context, event *linebot.Event) error {
+	if event.Postback == nil {
+		return ErrMalformed
+	}
+
+	p, err := Decode(d.secret, event.Postback.Data, time.Now())
+	if err != nil {
+		return err
+	}
+
+	h, ok := d.handlers[p.Action]
+	if !ok {
+		return ErrUnknownAction
+	}
+	h(ctx, event, p)
+
+	return nil
+}
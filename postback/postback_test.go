@@ -0,0 +1,106 @@
+package postback
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	now := time.Unix(1496390400, 0)
+	p := Payload{Action: "threshold", Args: url.Values{"r": {"新竹縣/尖石鄉"}, "mm": {"40"}}, Expires: now.Add(10 * time.Minute)}
+
+	data, err := Encode("secret", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(data, "mm=40", "mm=80", 1)
+
+	tests := []struct {
+		name   string
+		secret string
+		data   string
+		now    time.Time
+		err    error
+	}{
+		{"valid", "secret", data, now, nil},
+		{"valid until expiry", "secret", data, now.Add(10 * time.Minute), nil},
+		{"expired", "secret", data, now.Add(10*time.Minute + time.Second), ErrExpired},
+		{"other secret", "other", data, now, ErrInvalidSignature},
+		{"tampered args", "secret", tampered, now, ErrInvalidSignature},
+		{"no signature", "secret", "threshold", now, ErrMalformed},
+		{"truncated signature", "secret", data[:len(data)-1], now, ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		got, err := Decode(tt.secret, tt.data, tt.now)
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Action != p.Action || got.Args.Get("r") != "新竹縣/尖石鄉" || got.Args.Get("mm") != "40" || !got.Expires.Equal(p.Expires) {
+			t.Errorf("%s: Decode = %+v, want %+v", tt.name, got, p)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	expires := time.Unix(1496390400, 0)
+	tests := []struct {
+		name string
+		p    Payload
+		err  error
+	}{
+		{"no action", Payload{Expires: expires}, ErrMalformed},
+		{"separator in action", Payload{Action: "a|b", Expires: expires}, ErrMalformed},
+		{"too long", Payload{Action: "region", Args: url.Values{"r": {strings.Repeat("新", 100)}}, Expires: expires}, ErrTooLong},
+	}
+	for _, tt := range tests {
+		if _, err := Encode("secret", tt.p); err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	d := NewDispatcher("secret", time.Minute)
+	var got *Payload
+	d.Handle("region", func(ctx context.Context, event *linebot.Event, p *Payload) {
+		got = p
+	})
+
+	data, err := d.Data("region", url.Values{"r": {"新竹市"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := d.Data("unknown", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		event *linebot.Event
+		err   error
+	}{
+		{"handled", &linebot.Event{Postback: &linebot.Postback{Data: data}}, nil},
+		{"unknown action", &linebot.Event{Postback: &linebot.Postback{Data: unknown}}, ErrUnknownAction},
+		{"no postback", &linebot.Event{}, ErrMalformed},
+	}
+	for _, tt := range tests {
+		got = nil
+		err := d.Dispatch(context.Background(), tt.event)
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		if (err == nil) != (got != nil) {
+			t.Errorf("%s: handler called = %v", tt.name, got != nil)
+		}
+	}
+}
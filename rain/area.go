@@ -0,0 +1,118 @@
+package rain
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/capalert"
+	"github.com/lancetw/hcfd-forecast-v1/geo"
+)
+
+// areaPrefix marks the region of alerts raised for an uploaded area
+const areaPrefix = "area:"
+
+// TWD67 to WGS 84 offsets over Taiwan, about 828 m east and 207 m south
+const (
+	twd67LonShift = 0.00814
+	twd67LatShift = -0.00186
+)
+
+// Point is the WGS 84 position of the station of location; lat and lon are given
+// in TWD67, so they are shifted when the feed has no lat_wgs84 and lon_wgs84
+func (location Location0) Point() geo.Point {
+	if location.LatWGS84 != 0 && location.LonWGS84 != 0 {
+		return geo.Point{Lon: float64(location.LonWGS84), Lat: float64(location.LatWGS84)}
+	}
+	if location.Lat == 0 && location.Lon == 0 {
+		return geo.Point{}
+	}
+	return geo.Point{Lon: float64(location.Lon) + twd67LonShift, Lat: float64(location.Lat) + twd67LatShift}
+}
+
+// AreaTarget is the region of the alerts of the area id
+func AreaTarget(id string) string {
+	return areaPrefix + id
+}
+
+// IsAreaTarget reports whether region is that of an uploaded area
+func IsAreaTarget(region string) bool {
+	return strings.HasPrefix(region, areaPrefix)
+}
+
+// AreaRainingAlerts "雨量警示" for the stations inside area whose hourly rain reaches hourly mm
+func AreaRainingAlerts(locations []Location0, area geo.Area, hourly float32) []Alert {
+	alerts := rainingAlerts(locations, func(location Location0) (string, bool) {
+		return AreaTarget(area.ID), area.Contains(location.Point())
+	}, hourly)
+
+	for i := range alerts {
+		alerts[i].Text = "《" + area.Name + "》" + alerts[i].Text
+	}
+	return alerts
+}
+
+// CAPAreaAlerts converts the info blocks of caps in effect at now whose polygons intersect one of areas,
+// leaving out the messages cancelled or updated since
+func CAPAreaAlerts(caps []*capalert.Alert, areas []geo.Area, now time.Time) []Alert {
+	var alerts = []Alert{}
+
+	retracted := Retracted(caps)
+	for _, c := range caps {
+		if c.Status != "Actual" || c.MsgType == "Cancel" || retracted[c.Identifier] {
+			continue
+		}
+
+		for _, info := range localInfo(c.Info) {
+			if !info.Active(now) {
+				continue
+			}
+
+			polygons := capPolygons(info.Area)
+			for _, area := range areas {
+				if !intersectsAny(area, polygons) {
+					continue
+				}
+
+				alerts = append(alerts, Alert{
+					Dataset: "NCDR",
+					Region:  AreaTarget(area.ID),
+					Level:   capLevel(info.Severity),
+					Text:    capText(area.Name, info),
+					Key:     AreaTarget(area.ID) + "|" + c.Identifier,
+					Expires: capExpires(info),
+					Ref:     c.Identifier,
+				})
+			}
+		}
+	}
+
+	return alerts
+}
+
+// capPolygons converts the well-formed CAP polygons of areas, which are in lat,lon order
+func capPolygons(areas []capalert.Area) []geo.Polygon {
+	var polygons []geo.Polygon
+	for _, area := range areas {
+		for _, s := range area.Polygon {
+			points, err := capalert.ParsePolygon(strings.TrimSpace(s))
+			if err != nil {
+				continue
+			}
+			var ring []geo.Point
+			for _, p := range points {
+				ring = append(ring, geo.Point{Lon: p.Lon, Lat: p.Lat})
+			}
+			polygons = append(polygons, geo.Polygon{ring})
+		}
+	}
+	return polygons
+}
+
+func intersectsAny(area geo.Area, polygons []geo.Polygon) bool {
+	for _, poly := range polygons {
+		if area.Intersects(poly) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package rain
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/lancetw/hcfd-forecast-v1/geo"
+)
+
+// hsinchuCity roughly outlines 新竹市
+var hsinchuCity = geo.Area{
+	ID:   "hsinchu",
+	Name: "新竹市",
+	Polygons: []geo.Polygon{{{
+		{Lon: 120.90, Lat: 24.86}, {Lon: 121.03, Lat: 24.85}, {Lon: 121.03, Lat: 24.76},
+		{Lon: 120.88, Lat: 24.72}, {Lon: 120.90, Lat: 24.86},
+	}}},
+}
+
+func TestLocationPoint(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want geo.Point
+		in   bool
+	}{
+		{
+			"新竹 in WGS 84",
+			`<location><lat>24.8300</lat><lon>121.0060</lon><lat_wgs84>24.8279</lat_wgs84><lon_wgs84>121.0142</lon_wgs84><locationName>新竹</locationName></location>`,
+			geo.Point{Lon: 121.0142, Lat: 24.8279},
+			true,
+		},
+		{
+			"新竹 in TWD67 only",
+			`<location><lat>24.8300</lat><lon>121.0060</lon><locationName>新竹</locationName></location>`,
+			geo.Point{Lon: 121.0060 + twd67LonShift, Lat: 24.8300 + twd67LatShift},
+			true,
+		},
+		{
+			"竹東",
+			`<location><lat_wgs84>24.7354</lat_wgs84><lon_wgs84>121.0898</lon_wgs84><locationName>竹東</locationName></location>`,
+			geo.Point{Lon: 121.0898, Lat: 24.7354},
+			false,
+		},
+		{
+			"no position",
+			`<location><locationName>無座標</locationName></location>`,
+			geo.Point{},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		var location Location0
+		if err := xml.Unmarshal([]byte(tt.data), &location); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := location.Point()
+		if !near(got, tt.want) {
+			t.Errorf("%s: Point = %v, want %v", tt.name, got, tt.want)
+		}
+		if in := hsinchuCity.Contains(got); in != tt.in {
+			t.Errorf("%s: in 新竹市 = %v, want %v", tt.name, in, tt.in)
+		}
+	}
+}
+
+func TestAreaRainingAlerts(t *testing.T) {
+	station := func(name string, lat float32, lon float32, rain float32) Location0 {
+		return Location0{
+			Name:           name,
+			LatWGS84:       lat,
+			LonWGS84:       lon,
+			WeatherElement: []WeatherElement{{Name: "RAIN", Value: rain}},
+		}
+	}
+	locations := []Location0{
+		station("新竹", 24.8279, 121.0142, 45),
+		station("竹東", 24.7354, 121.0898, 80),
+		station("香山", 24.7639, 120.9186, 5),
+	}
+
+	alerts := AreaRainingAlerts(locations, hsinchuCity, 40)
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %v", len(alerts), alerts)
+	}
+	if alerts[0].Region != AreaTarget("hsinchu") {
+		t.Errorf("Region = %q, want %q", alerts[0].Region, AreaTarget("hsinchu"))
+	}
+}
+
+func near(a geo.Point, b geo.Point) bool {
+	const epsilon = 1e-4
+	return a.Lon-b.Lon < epsilon && b.Lon-a.Lon < epsilon && a.Lat-b.Lat < epsilon && b.Lat-a.Lat < epsilon
+}
@@ -0,0 +1,169 @@
+package rain
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+)
+
+// ForecastLocation struct
+type ForecastLocation struct {
+	Name           string            `xml:"locationName"`
+	WeatherElement []ForecastElement `xml:"weatherElement"`
+}
+
+// ForecastElement struct
+type ForecastElement struct {
+	Name string         `xml:"elementName"`
+	Time []ForecastTime `xml:"time"`
+}
+
+// ForecastTime struct
+type ForecastTime struct {
+	StartTime time.Time `xml:"startTime"`
+	EndTime   time.Time `xml:"endTime"`
+	Value     string    `xml:"parameter>parameterName"`
+}
+
+// ResultForecast struct
+type ResultForecast struct {
+	Sent     time.Time          `xml:"sent"`
+	Location []ForecastLocation `xml:"dataset>location"`
+}
+
+// FetchForecast downloads F-C0032-001
+func FetchForecast(ctx context.Context) (*ResultForecast, error) {
+	xmldata := fetchXML(ctx, "F-C0032-001")
+
+	v := &ResultForecast{}
+	if err := xml.Unmarshal([]byte(xmldata), v); err != nil {
+		return nil, err
+	}
+	recordsParsed.Set(float64(len(v.Location)), "F-C0032-001")
+	seen("F-C0032-001", v.Sent)
+	return v, nil
+}
+
+// GetForecast "今明 36 小時天氣預報" for the counties of targets
+func GetForecast(ctx context.Context, targets []string) ([]string, error) {
+	var msgs = []string{}
+	targets = counties(targets)
+
+	v, err := FetchForecast(ctx)
+	if err != nil {
+		return msgs, err
+	}
+
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		location = time.Local
+	}
+
+	for _, forecast := range v.Location {
+		if !contains(targets, forecast.Name) {
+			continue
+		}
+
+		elements := map[string][]ForecastTime{}
+		for _, element := range forecast.WeatherElement {
+			elements[element.Name] = element.Time
+		}
+
+		msg := fmt.Sprintf("【%s】", forecast.Name)
+		for i, period := range elements["Wx"] {
+			msg = msg + fmt.Sprintf("\n%s ~ %s %s",
+				period.StartTime.In(location).Format("01/02 15:04"),
+				period.EndTime.In(location).Format("15:04"),
+				period.Value)
+			if i < len(elements["MinT"]) && i < len(elements["MaxT"]) {
+				msg = msg + fmt.Sprintf(" %s-%s°C", elements["MinT"][i].Value, elements["MaxT"][i].Value)
+			}
+			if i < len(elements["PoP"]) {
+				msg = msg + fmt.Sprintf(" 降雨機率 %s%%", elements["PoP"][i].Value)
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+type station struct {
+	name  string
+	city  string
+	value float32
+}
+
+type byValue []station
+
+func (s byValue) Len() int           { return len(s) }
+func (s byValue) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byValue) Less(i, j int) bool { return s[i].value > s[j].value }
+
+// RainfallMaxima lists the n stations of targets with the most rain in the last 24 hours
+func RainfallMaxima(locations []Location0, targets []string, n int) []string {
+	var stations []station
+	for _, location := range locations {
+		city, town := locationPlace(location)
+		if _, ok := matchTarget(targets, city, town); !ok {
+			continue
+		}
+
+		for _, element := range location.WeatherElement {
+			if element.Name == "HOUR_24" && element.Value > 0 {
+				stations = append(stations, station{location.Name, city, element.Value})
+			}
+		}
+	}
+
+	sort.Sort(byValue(stations))
+	if len(stations) > n {
+		stations = stations[:n]
+	}
+
+	var msgs = []string{}
+	for _, s := range stations {
+		msgs = append(msgs, fmt.Sprintf("%s %s：%.1f mm", s.city, s.name, s.value))
+	}
+	return msgs
+}
+
+// Briefing "天氣簡報" of targets: 24 hour rainfall maxima, active warnings and 36 hour forecast
+func Briefing(ctx context.Context, targets []string) string {
+	var sections []string
+
+	locations, _, err := FetchRaining(ctx)
+	if err == nil {
+		maxima := RainfallMaxima(locations, targets, 5)
+		if len(maxima) == 0 {
+			maxima = []string{"無降雨"}
+		}
+		sections = append(sections, "＊24 小時累積雨量＊\n"+strings.Join(maxima, "\n"))
+	}
+
+	// without the token the fetch failed, and no alerts must not read as an all-clear
+	alerts, token := GetWarningAlerts(ctx, targets)
+	var warnings []string
+	for _, alert := range alerts {
+		warnings = append(warnings, strings.TrimSpace(alert.Text))
+	}
+	if token == "" {
+		logger.FromContext(ctx).Warn("Briefing without warnings", logger.Fields{"dataset": "W-C0033-001"})
+		warnings = []string{"警報資料暫時無法取得"}
+	} else if len(warnings) == 0 {
+		warnings = []string{"目前沒有天氣警報"}
+	}
+	sections = append(sections, "＊天氣警報＊\n"+strings.Join(warnings, "\n"))
+
+	forecasts, err := GetForecast(ctx, targets)
+	if err == nil && len(forecasts) > 0 {
+		sections = append(sections, "＊36 小時預報＊\n"+strings.Join(forecasts, "\n"))
+	}
+
+	return "【天氣簡報】\n\n" + strings.Join(sections, "\n\n")
+}
@@ -0,0 +1,97 @@
+package rain
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+)
+
+// CachedDataset is a downloaded dataset with its validators for conditional GET
+type CachedDataset struct {
+	Body         []byte
+	ETag         string
+	LastModified string
+	Fetched      time.Time
+}
+
+// Cache shares downloaded datasets between the web and worker processes,
+// storing each as a few string fields so stores need not know CachedDataset
+type Cache interface {
+	Get(dataset string) (map[string]string, error)
+	Set(dataset string, fields map[string]string) error
+}
+
+// cacheTTL follows the update cadence of each dataset
+var cacheTTL = map[string]time.Duration{
+	"O-A0002-001": 10 * time.Minute,
+	"W-C0033-001": 2 * time.Minute,
+	"F-C0032-001": 30 * time.Minute,
+	"NCDR":        2 * time.Minute,
+}
+
+var cache struct {
+	store   Cache
+	refresh bool
+}
+
+// SetCache makes downloads go through store; with refresh every download is
+// revalidated against CWB, otherwise fresh entries are served as they are
+func SetCache(store Cache, refresh bool) {
+	cache.store = store
+	cache.refresh = refresh
+}
+
+// CacheTTL returns how long dataset stays fresh; CACHE_TTL_O_A0002_001 style variables override it
+func CacheTTL(dataset string) time.Duration {
+	key := "CACHE_TTL_" + strings.Replace(dataset, "-", "_", -1)
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return d
+	}
+	if d, ok := cacheTTL[dataset]; ok {
+		return d
+	}
+	return 5 * time.Minute
+}
+
+func loadCache(ctx context.Context, dataset string) *CachedDataset {
+	if cache.store == nil {
+		return nil
+	}
+
+	fields, err := cache.store.Get(dataset)
+	if err != nil {
+		logger.FromContext(ctx).Error("Cache get error", err, logger.Fields{"dataset": dataset})
+		return nil
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	fetched, _ := strconv.ParseInt(fields["fetched"], 10, 64)
+	return &CachedDataset{
+		Body:         []byte(fields["body"]),
+		ETag:         fields["etag"],
+		LastModified: fields["last_modified"],
+		Fetched:      time.Unix(fetched, 0),
+	}
+}
+
+func storeCache(ctx context.Context, dataset string, entry *CachedDataset) {
+	if cache.store == nil {
+		return
+	}
+
+	fields := map[string]string{
+		"body":          string(entry.Body),
+		"etag":          entry.ETag,
+		"last_modified": entry.LastModified,
+		"fetched":       strconv.FormatInt(entry.Fetched.Unix(), 10),
+	}
+	if err := cache.store.Set(dataset, fields); err != nil {
+		logger.FromContext(ctx).Error("Cache set error", err, logger.Fields{"dataset": dataset})
+	}
+}
@@ -0,0 +1,30 @@
+package rain
+
+import "github.com/lancetw/hcfd-forecast-v1/metrics"
+
+var fetchDuration = metrics.NewHistogram(
+	"cwb_fetch_duration_seconds",
+	"Latency of CWB open data downloads.",
+	metrics.DefBuckets,
+	"dataset")
+
+var fetchFailures = metrics.NewCounter(
+	"cwb_fetch_failures_total",
+	"CWB open data downloads that failed.",
+	"dataset")
+
+var recordsParsed = metrics.NewGauge(
+	"cwb_records_parsed",
+	"Locations parsed from the last download of each dataset.",
+	"dataset")
+
+// AlertsGenerated counts alerts by dataset, region and level
+var AlertsGenerated = metrics.NewCounter(
+	"alerts_generated_total",
+	"Alerts generated, by dataset, region and grade.",
+	"dataset", "region", "grade")
+
+var cacheRequests = metrics.NewCounter(
+	"cwb_cache_requests_total",
+	"Dataset cache lookups, by result: hit, miss, not_modified or stale.",
+	"dataset", "result")
@@ -0,0 +1,213 @@
+package rain
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/capalert"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+)
+
+// ncdrFeedURL lists the CAP alerts of NCDR; NCDR_FEED_URL overrides it
+const ncdrFeedURL = "https://alerts.ncdr.nat.gov.tw/RssAtomFeed.ashx"
+
+// maxCAPEntries bounds the alerts downloaded from one feed
+const maxCAPEntries = 50
+
+// severityLevels maps CAP severities onto the rain grades used for floors
+var severityLevels = map[string]Level{
+	"Extreme":  LevelTorrential,
+	"Severe":   LevelExtremelyHeavy,
+	"Moderate": LevelHeavy,
+}
+
+// capLevel returns the rain grade of a CAP severity
+func capLevel(severity string) Level {
+	if level, ok := severityLevels[severity]; ok {
+		return level
+	}
+	return LevelWatch
+}
+
+func feedURL() string {
+	if url := os.Getenv("NCDR_FEED_URL"); url != "" {
+		return url
+	}
+	return ncdrFeedURL
+}
+
+// FetchCAP downloads the CAP alerts listed in the NCDR feed
+func FetchCAP(ctx context.Context) ([]*capalert.Alert, error) {
+	lg := logger.FromContext(ctx).With(logger.Fields{"dataset": "NCDR"})
+
+	feed, err := capalert.ParseFeed(fetchURL(ctx, "NCDR", "NCDR", feedURL()))
+	if err != nil {
+		return nil, err
+	}
+	seen("NCDR", feed.Updated)
+
+	var alerts []*capalert.Alert
+	for i, entry := range feed.Entry {
+		if i == maxCAPEntries {
+			break
+		}
+
+		if entry.Content != nil && entry.Content.Alert != nil {
+			alerts = append(alerts, entry.Content.Alert)
+			continue
+		}
+
+		href := entry.Href()
+		if href == "" {
+			continue
+		}
+		alert, parseErr := capalert.Parse(fetchDocument(ctx, "NCDR-CAP", "NCDR:"+entry.ID, href))
+		if parseErr != nil {
+			lg.Error("CAP parse error", parseErr, logger.Fields{"entry": entry.ID})
+			continue
+		}
+		alerts = append(alerts, alert)
+	}
+
+	lg.Info("取得 NCDR 示警資料", logger.Fields{"records": len(alerts)})
+	recordsParsed.Set(float64(len(alerts)), "NCDR")
+
+	return alerts, nil
+}
+
+// fetchDocument returns the cached CAP document of key without revalidating it, as a CAP
+// message never changes once issued; updates come as new messages
+func fetchDocument(ctx context.Context, dataset string, key string, url string) []byte {
+	if entry := loadCache(ctx, key); entry != nil {
+		cacheRequests.Inc(dataset, "hit")
+		return entry.Body
+	}
+	return fetchURL(ctx, dataset, key, url)
+}
+
+// Retracted returns the identifiers of the messages cancelled or updated by one of caps
+func Retracted(caps []*capalert.Alert) map[string]bool {
+	retracted := map[string]bool{}
+	for _, c := range caps {
+		if c.MsgType != "Cancel" && c.MsgType != "Update" {
+			continue
+		}
+		for _, id := range c.ReferencedIDs() {
+			retracted[id] = true
+		}
+	}
+	return retracted
+}
+
+// GetCAPAlerts "NCDR 示警" in effect for the counties of targets, one alert per county and CAP alert
+func GetCAPAlerts(ctx context.Context, targets []string) []Alert {
+	caps, err := FetchCAP(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("GetCAPAlerts fetchXML error", err, logger.Fields{"dataset": "NCDR"})
+		return []Alert{}
+	}
+	return CAPAlerts(caps, counties(targets), time.Now())
+}
+
+// CAPAlerts converts the info blocks of caps in effect at now whose areas cover one of cities,
+// leaving out the messages cancelled or updated since; with nil cities every area is converted,
+// its description as the region
+func CAPAlerts(caps []*capalert.Alert, cities []string, now time.Time) []Alert {
+	var alerts = []Alert{}
+
+	retracted := Retracted(caps)
+	for _, c := range caps {
+		if c.Status != "Actual" || c.MsgType == "Cancel" || retracted[c.Identifier] {
+			continue
+		}
+
+		for _, info := range localInfo(c.Info) {
+			if !info.Active(now) {
+				continue
+			}
+
+			regions := cities
+			if regions == nil {
+				for _, area := range info.Area {
+					regions = append(regions, area.Desc)
+				}
+			}
+
+			for _, city := range regions {
+				if !covers(info.Area, city) {
+					continue
+				}
+				alerts = append(alerts, Alert{
+					Dataset: "NCDR",
+					Region:  city,
+					Level:   capLevel(info.Severity),
+					Text:    capText(city, info),
+					Key:     city + "|" + c.Identifier,
+					Expires: capExpires(info),
+					Ref:     c.Identifier,
+				})
+			}
+		}
+	}
+
+	return alerts
+}
+
+// capExpires is the expiry of info, zero when it has none
+func capExpires(info capalert.Info) time.Time {
+	if info.Expires == nil {
+		return time.Time{}
+	}
+	return *info.Expires
+}
+
+// localInfo keeps the Chinese info blocks, or all of them when there are none
+func localInfo(infos []capalert.Info) []capalert.Info {
+	var local []capalert.Info
+	for _, info := range infos {
+		if info.Language == "" || strings.HasPrefix(strings.ToLower(info.Language), "zh") {
+			local = append(local, info)
+		}
+	}
+	if len(local) == 0 {
+		return infos
+	}
+	return local
+}
+
+// covers reports whether one of areas lies in city
+func covers(areas []capalert.Area, city string) bool {
+	city = strings.Replace(city, "台", "臺", -1)
+	for _, area := range areas {
+		if strings.Contains(strings.Replace(area.Desc, "台", "臺", -1), city) {
+			return true
+		}
+	}
+	return false
+}
+
+func capText(city string, info capalert.Info) string {
+	title := info.Headline
+	if title == "" {
+		title = info.Event
+	}
+
+	m := fmt.Sprintf("【%s】%s\n", city, title)
+	if info.Description != "" {
+		m = m + info.Description + "\n"
+	}
+	if info.Effective != nil && info.Expires != nil {
+		m = m + fmt.Sprintf(" %s ~\n %s\n", localTime(*info.Effective).Format("01/02 15:04"), localTime(*info.Expires).Format("01/02 15:04"))
+	}
+	return m
+}
+
+func localTime(t time.Time) time.Time {
+	if location, err := time.LoadLocation(timeZone); err == nil {
+		return t.In(location)
+	}
+	return t
+}
@@ -0,0 +1,122 @@
+package rain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/capalert"
+	"github.com/lancetw/hcfd-forecast-v1/geo"
+)
+
+func TestCAPAlerts(t *testing.T) {
+	now := time.Date(2023, 6, 2, 8, 0, 0, 0, time.UTC)
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+
+	message := func(id string, msgType string, references string, expires *time.Time, areas ...string) *capalert.Alert {
+		info := capalert.Info{Language: "zh-TW", Event: "降雨", Severity: "Severe", Headline: "豪雨特報", Expires: expires}
+		for _, area := range areas {
+			info.Area = append(info.Area, capalert.Area{Desc: area})
+		}
+		return &capalert.Alert{Identifier: id, Status: "Actual", MsgType: msgType, References: references, Info: []capalert.Info{info}}
+	}
+
+	tests := []struct {
+		name   string
+		caps   []*capalert.Alert
+		cities []string
+		want   []string
+	}{
+		{
+			"covered county",
+			[]*capalert.Alert{message("a1", "Alert", "", &later, "新竹縣尖石鄉", "苗栗縣")},
+			[]string{"新竹縣", "新竹市"},
+			[]string{"新竹縣|a1"},
+		},
+		{
+			"台 and 臺 match",
+			[]*capalert.Alert{message("a1", "Alert", "", &later, "臺中市")},
+			[]string{"台中市"},
+			[]string{"台中市|a1"},
+		},
+		{
+			"expired",
+			[]*capalert.Alert{message("a1", "Alert", "", &earlier, "新竹縣")},
+			[]string{"新竹縣"},
+			nil,
+		},
+		{
+			"cancelled",
+			[]*capalert.Alert{
+				message("a1", "Alert", "", &later, "新竹縣"),
+				message("c1", "Cancel", "cwb,a1,2023-06-02T07:00:00+08:00", &later, "新竹縣"),
+			},
+			[]string{"新竹縣"},
+			nil,
+		},
+		{
+			"updated",
+			[]*capalert.Alert{
+				message("a1", "Alert", "", &later, "新竹縣"),
+				message("u1", "Update", "cwb,a1,2023-06-02T07:00:00+08:00", &later, "新竹縣"),
+			},
+			[]string{"新竹縣"},
+			[]string{"新竹縣|u1"},
+		},
+		{
+			"every area without cities",
+			[]*capalert.Alert{message("a1", "Alert", "", nil, "新竹縣", "宜蘭縣")},
+			nil,
+			[]string{"新竹縣|a1", "宜蘭縣|a1"},
+		},
+		{
+			"test messages",
+			[]*capalert.Alert{{Identifier: "t1", Status: "Test", MsgType: "Alert", Info: []capalert.Info{{Area: []capalert.Area{{Desc: "新竹縣"}}}}}},
+			[]string{"新竹縣"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		alerts := CAPAlerts(tt.caps, tt.cities, now)
+		if len(alerts) != len(tt.want) {
+			t.Errorf("%s: got %d alerts, want %v", tt.name, len(alerts), tt.want)
+			continue
+		}
+		for i, alert := range alerts {
+			if alert.Key != tt.want[i] || alert.Level != LevelExtremelyHeavy {
+				t.Errorf("%s: alert %d = %q %v, want %q", tt.name, i, alert.Key, alert.Level, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestCAPAreaAlerts(t *testing.T) {
+	now := time.Date(2023, 6, 2, 8, 0, 0, 0, time.UTC)
+	message := func(id string, polygon string) *capalert.Alert {
+		return &capalert.Alert{
+			Identifier: id,
+			Status:     "Actual",
+			MsgType:    "Alert",
+			Info: []capalert.Info{{
+				Severity: "Extreme",
+				Headline: "土石流警戒",
+				Area:     []capalert.Area{{Desc: "新竹縣", Polygon: []string{polygon}}},
+			}},
+		}
+	}
+	caps := []*capalert.Alert{
+		// over 新竹市, in lat,lon order
+		message("over", "24.84,120.95 24.84,121.00 24.78,121.00 24.78,120.95 24.84,120.95"),
+		// over 竹東 only
+		message("east", "24.76,121.06 24.76,121.12 24.70,121.12 24.70,121.06 24.76,121.06"),
+		message("malformed", "24.84,120.95 24.84,121.00"),
+	}
+
+	alerts := CAPAreaAlerts(caps, []geo.Area{hsinchuCity}, now)
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %v", len(alerts), alerts)
+	}
+	if alerts[0].Region != AreaTarget("hsinchu") || alerts[0].Ref != "over" || alerts[0].Level != LevelTorrential {
+		t.Errorf("alert = %q %q %v", alerts[0].Region, alerts[0].Ref, alerts[0].Level)
+	}
+}
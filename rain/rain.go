@@ -1,19 +1,27 @@
 package rain
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/logger"
 )
 
 // Location0 struct
 type Location0 struct {
 	Lat            float32          `xml:"lat"`
-	Lng            float32          `xml:"lng"`
+	Lon            float32          `xml:"lon"`
+	LatWGS84       float32          `xml:"lat_wgs84"`
+	LonWGS84       float32          `xml:"lon_wgs84"`
 	Name           string           `xml:"locationName"`
 	StationID      string           `xml:"stationId"`
 	Time           time.Time        `xml:"time>obsTime"`
@@ -23,9 +31,9 @@ type Location0 struct {
 
 // Location1 struct
 type Location1 struct {
-	Geocode int     `xml:"geocode"`
-	Name    string  `xml:"locationName"`
-	Hazards Hazards `xml:"hazardConditions>hazards"`
+	Geocode int      `xml:"geocode"`
+	Name    string   `xml:"locationName"`
+	Hazards []Hazard `xml:"hazardConditions>hazards"`
 }
 
 // WeatherElement struct
@@ -65,8 +73,8 @@ type HazardInfo1 struct {
 	AffectedAreas []AffectedAreas `xml:"affectedAreas>location"`
 }
 
-// Hazards struct
-type Hazards struct {
+// Hazard struct, one of the warnings in effect for a location
+type Hazard struct {
 	Info       HazardInfo0 `xml:"info"`
 	ValidTime  ValidTime   `xml:"validTime"`
 	HazardInfo HazardInfo1 `xml:"hazard>info"`
@@ -74,11 +82,13 @@ type Hazards struct {
 
 // ResultRaining struct
 type ResultRaining struct {
+	Sent     time.Time   `xml:"sent"`
 	Location []Location0 `xml:"location"`
 }
 
 // ResultWarning struct
 type ResultWarning struct {
+	Sent     time.Time   `xml:"sent"`
 	Location []Location1 `xml:"dataset>location"`
 }
 
@@ -86,94 +96,317 @@ const baseURL = "http://opendata.cwb.gov.tw/opendataapi?dataid="
 const authKey = "CWB-FB35C2AC-9286-4B7E-AD11-6BBB7F2855F7"
 const timeZone = "Asia/Taipei"
 
-func fetchXML(url string) []byte {
-	resp, err := http.Get(url)
+func fetchXML(ctx context.Context, dataset string) []byte {
+	return fetchURL(ctx, dataset, dataset, baseURL+dataset+"&authorizationkey="+authKey)
+}
+
+// fetchURL downloads url through the cache entry key, reporting it as dataset
+func fetchURL(ctx context.Context, dataset string, key string, url string) []byte {
+	lg := logger.FromContext(ctx).With(logger.Fields{"dataset": dataset})
+
+	entry := loadCache(ctx, key)
+	if entry != nil && !cache.refresh && time.Since(entry.Fetched) < CacheTTL(key) {
+		cacheRequests.Inc(dataset, "hit")
+		return entry.Body
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		fmt.Printf("fetchXML http.Get error: %v", err)
-		os.Exit(1)
+		lg.Error("fetchXML request error", err)
+		return nil
+	}
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	fetchDuration.Observe(time.Since(start).Seconds(), dataset)
+	if err == nil && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		err = fmt.Errorf("status %s", resp.Status)
+	}
+	if err != nil {
+		fetchFailures.Inc(dataset)
+		lg.Error("fetchXML http.Get error", err)
+		if entry != nil {
+			cacheRequests.Inc(dataset, "stale")
+			return entry.Body
+		}
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		cacheRequests.Inc(dataset, "not_modified")
+		entry.Fetched = time.Now()
+		storeCache(ctx, key, entry)
+		return entry.Body
 	}
 
 	xmldata, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		fmt.Printf("fetchXML ioutil.ReadAll error: %v", err)
+		fetchFailures.Inc(dataset)
+		lg.Error("fetchXML ioutil.ReadAll error", err)
 		return nil
 	}
 
+	cacheRequests.Inc(dataset, "miss")
+	storeCache(ctx, key, &CachedDataset{
+		Body:         xmldata,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	})
+
+	lg.Debug("fetchXML", logger.Fields{"duration": time.Since(start).String(), "bytes": len(xmldata)})
 	return xmldata
 }
 
-// GetRainingInfo "雨量警示"
-func GetRainingInfo(targets []string, noLevel bool) ([]string, string) {
-	var token = "O-A0002-001 "
-	var msgs = []string{}
+// Level of an alert, following the CWB rain grades; the wind and typhoon
+// warnings rank above them so quiet hours never defer them
+type Level int
+
+// Level constants
+const (
+	LevelNone Level = iota
+	LevelWatch
+	LevelHeavy
+	LevelExtremelyHeavy
+	LevelTorrential
+	LevelExtremelyTorrential
+	LevelWind
+	LevelTyphoon
+)
+
+var levelNames = []string{"", "警示", "大雨", "豪雨", "大豪雨", "超大豪雨", "強風", "颱風"}
+
+// String returns the Chinese name of the level
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return ""
+	}
+	return levelNames[l]
+}
 
-	rainLevel := map[string]float32{
-		"10minutes": 5,  // 5
-		"1hour":     20, // 20
+// ParseLevel parses a Chinese level name such as "豪雨"
+func ParseLevel(name string) (Level, bool) {
+	for i, levelName := range levelNames {
+		if i > 0 && levelName == name {
+			return Level(i), true
+		}
 	}
+	return LevelNone, false
+}
+
+// Alert is one message for a region together with its level
+type Alert struct {
+	Dataset string
+	Region  string
+	Level   Level
+	Text    string
+	Key     string
 
-	url := baseURL + "O-A0002-001" + "&authorizationkey=" + authKey
-	xmldata := fetchXML(url)
+	// Expires is the end of the validity of the alert, zero when unknown
+	Expires time.Time
+
+	// Ref is the identifier of the CAP message the alert comes from, if any
+	Ref string
+}
+
+// ID identifies the alert by its dataset and content
+func (a Alert) ID() string {
+	key := a.Key
+	if key == "" {
+		key = a.Text
+	}
+	sum := sha256.Sum256([]byte(a.Dataset + "|" + key))
+	return hex.EncodeToString(sum[:12])
+}
+
+// Digest identifies a set of alerts, so it changes whenever one is added, removed or amended
+func Digest(alerts []Alert) string {
+	var ids []string
+	for _, alert := range alerts {
+		ids = append(ids, alert.ID())
+	}
+	sort.Strings(ids)
+
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return hex.EncodeToString(sum[:12])
+}
+
+// DefaultHourly is the default hourly rain (mm) that raises an alert
+const DefaultHourly = 20
+
+// RainAlertLifetime is how long an observed rain alert stays in effect
+const RainAlertLifetime = time.Hour
+
+// rainLevel returns the CWB grade of a station from its accumulations
+func rainLevel(elements map[string]float32) Level {
+	switch {
+	case elements["HOUR_24"] >= 500:
+		return LevelExtremelyTorrential
+	case elements["HOUR_24"] >= 350:
+		return LevelTorrential
+	case elements["HOUR_24"] >= 200 || elements["HOUR_3"] >= 100:
+		return LevelExtremelyHeavy
+	case elements["HOUR_24"] >= 80 || elements["RAIN"] >= 40:
+		return LevelHeavy
+	}
+	return LevelWatch
+}
+
+// warningLevel returns the level of a W-C0033-001 phenomena
+func warningLevel(phenomena string) Level {
+	switch {
+	case strings.Contains(phenomena, "颱風"):
+		return LevelTyphoon
+	case strings.Contains(phenomena, "強風"):
+		return LevelWind
+	}
+	for l := LevelExtremelyTorrential; l > LevelWatch; l-- {
+		if strings.Contains(phenomena, l.String()) {
+			return l
+		}
+	}
+	return LevelWatch
+}
+
+// FetchRaining downloads O-A0002-001 and returns its stations and observation token
+func FetchRaining(ctx context.Context) ([]Location0, string, error) {
+	xmldata := fetchXML(ctx, "O-A0002-001")
 
 	v := ResultRaining{}
 	err := xml.Unmarshal([]byte(xmldata), &v)
 	if err != nil {
-		log.Printf("GetRainingInfo fetchXML error: %v", err)
+		return nil, "", err
+	}
+
+	logger.FromContext(ctx).Info("取得地區雨量資料", logger.Fields{"dataset": "O-A0002-001", "records": len(v.Location)})
+	recordsParsed.Set(float64(len(v.Location)), "O-A0002-001")
+
+	latest := LatestObservation(v.Location)
+	seen("O-A0002-001", latest)
+
+	var token string
+	if !latest.IsZero() {
+		token = latest.Format("20060102150405")
+	}
+
+	return v.Location, token, nil
+}
+
+// LatestObservation returns the most recent observation time of locations
+func LatestObservation(locations []Location0) time.Time {
+	var latest time.Time
+	for _, location := range locations {
+		if location.Time.After(latest) {
+			latest = location.Time
+		}
+	}
+	return latest
+}
+
+// RainingAlerts "雨量警示" for stations of targets whose hourly rain reaches hourly mm
+func RainingAlerts(locations []Location0, targets []string, hourly float32) []Alert {
+	return rainingAlerts(locations, func(location Location0) (string, bool) {
+		city, town := locationPlace(location)
+		return matchTarget(targets, city, town)
+	}, hourly)
+}
+
+// rainingAlerts "雨量警示" for the stations to which region assigns a region
+func rainingAlerts(locations []Location0, region func(Location0) (string, bool), hourly float32) []Alert {
+	var alerts = []Alert{}
+
+	for _, location := range locations {
+		target, ok := region(location)
+		if !ok {
+			continue
+		}
+
+		elements := map[string]float32{}
+		for _, element := range location.WeatherElement {
+			elements[element.Name] = element.Value
+		}
+
+		var msg string
+		if elements["MIN_10"] >= 5 {
+			msg = msg + fmt.Sprintf("【%s】豪大雨警報\n%s：%.1f \n", location.Name, "$ 10分鐘雨量 $", elements["MIN_10"])
+		}
+		if elements["RAIN"] > 0 && elements["RAIN"] >= hourly {
+			msg = msg + fmt.Sprintf("【%s】豪大雨警報\n%s：%.1f \n", location.Name, "(時雨量)", elements["RAIN"])
+		}
+
+		if msg != "" {
+			alerts = append(alerts, Alert{
+				Dataset: "O-A0002-001",
+				Region:  target,
+				Level:   rainLevel(elements),
+				Text:    msg,
+				Expires: location.Time.Add(RainAlertLifetime),
+			})
+		}
+	}
+
+	return alerts
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRainingInfo "雨量警示"
+func GetRainingInfo(ctx context.Context, targets []string, noLevel bool) ([]string, string) {
+	locations, token, err := FetchRaining(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("GetRainingInfo fetchXML error", err, logger.Fields{"dataset": "O-A0002-001"})
 		return []string{}, ""
 	}
+	return RainingInfo(locations, targets, noLevel), token
+}
 
-	log.Printf("[取得 %d 筆地區雨量資料]\n", len(v.Location))
+// RainingInfo "雨量警示" of the stations of locations within targets
+func RainingInfo(locations []Location0, targets []string, noLevel bool) []string {
+	var msgs = []string{}
 
-	for _, location := range v.Location {
+	if !noLevel {
+		for _, alert := range RainingAlerts(locations, targets, DefaultHourly) {
+			msgs = append(msgs, alert.Text)
+		}
+		return msgs
+	}
+
+	for _, location := range locations {
 		var msg string
-		for _, parameter := range location.Parameter {
-			if parameter.Name == "CITY" {
-				for _, target := range targets {
-					if parameter.Value == target {
-						for _, element := range location.WeatherElement {
-							token = location.Time.Format("20060102150405")
-
-							switch element.Name {
-							case "MIN_10":
-								if noLevel {
-									if element.Value <= 0 {
-										msg = msg + fmt.Sprintf("%s：%s", "$ 10分鐘雨量 $", "-")
-									} else {
-										msg = msg + fmt.Sprintf("%s：%.1f", "$ 10分鐘雨量 $", element.Value)
-									}
-								} else {
-									if element.Value <= 0 {
-										//log.Printf("%s：%s", "*10分鐘雨量*", "-")
-									} else {
-										//log.Printf("%s：%.1f", "*10分鐘雨量*", element.Value)
-										if element.Value >= rainLevel["10minutes"] {
-											msg = msg + fmt.Sprintf("【%s】豪大雨警報\n%s：%.1f \n", location.Name, "$ 10分鐘雨量 $", element.Value)
-										}
-									}
-								}
-
-							case "RAIN":
-								if noLevel {
-									if element.Value <= 0 {
-										msg = msg + fmt.Sprintf("【%s】\n%s：%s\n", location.Name, "(時雨量)", "-")
-									} else {
-										msg = msg + fmt.Sprintf("【%s】\n%s：%.1f\n", location.Name, "(時雨量)", element.Value)
-									}
-								} else {
-									if element.Value <= 0 {
-										//log.Printf("[%s]", location.Name)
-										//log.Printf("%s：%s", "時雨量", "-")
-									} else {
-										//log.Printf("[%s]", location.Name)
-										//log.Printf("%s：%.1f", "時雨量", element.Value)
-										if element.Value >= rainLevel["1hour"] {
-											msg = msg + fmt.Sprintf("【%s】豪大雨警報\n%s：%.1f \n", location.Name, "(時雨量)", element.Value)
-										}
-									}
-								}
-							}
-						}
+		city, town := locationPlace(location)
+		if _, ok := matchTarget(targets, city, town); ok {
+			for _, element := range location.WeatherElement {
+				switch element.Name {
+				case "MIN_10":
+					if element.Value <= 0 {
+						msg = msg + fmt.Sprintf("%s：%s", "$ 10分鐘雨量 $", "-")
+					} else {
+						msg = msg + fmt.Sprintf("%s：%.1f", "$ 10分鐘雨量 $", element.Value)
+					}
+
+				case "RAIN":
+					if element.Value <= 0 {
+						msg = msg + fmt.Sprintf("【%s】\n%s：%s\n", location.Name, "(時雨量)", "-")
+					} else {
+						msg = msg + fmt.Sprintf("【%s】\n%s：%.1f\n", location.Name, "(時雨量)", element.Value)
 					}
 				}
 			}
@@ -184,25 +417,68 @@ func GetRainingInfo(targets []string, noLevel bool) ([]string, string) {
 		}
 	}
 
-	return msgs, token
+	if latest := LatestObservation(locations); len(msgs) > 0 && Stale("O-A0002-001", latest, time.Now()) {
+		msgs = append(msgs, StaleNote(latest))
+	}
+
+	return msgs
+}
+
+// StaleNote warns that data observed at t may no longer be updated
+func StaleNote(t time.Time) string {
+	location, err := time.LoadLocation(timeZone)
+	if err == nil {
+		t = t.In(location)
+	}
+	return fmt.Sprintf("⚠ 資料最後觀測於 %s，氣象局可能已停止更新", t.Format("01/02 15:04"))
 }
 
 // GetWarningInfo "豪大雨特報"
-func GetWarningInfo(targets []string) ([]string, string) {
-	var token = "W-C0033-001 "
+func GetWarningInfo(ctx context.Context, targets []string) ([]string, string) {
 	var msgs = []string{}
 
-	url := baseURL + "W-C0033-001" + "&authorizationkey=" + authKey
-	xmldata := fetchXML(url)
+	alerts, token := GetWarningAlerts(ctx, targets)
 
-	v := ResultWarning{}
-	err := xml.Unmarshal([]byte(xmldata), &v)
-	if err != nil {
-		log.Printf("GetWarningInfo fetchXML error: %v", err)
-		return []string{}, ""
+	var hazardmsgs = ""
+	for _, alert := range alerts {
+		hazardmsgs = hazardmsgs + alert.Text + "\n"
+	}
+
+	if hazardmsgs != "" {
+		msgs = append(msgs, hazardmsgs)
+	}
+
+	return msgs, token
+}
+
+// FetchWarnings downloads W-C0033-001
+func FetchWarnings(ctx context.Context) (*ResultWarning, error) {
+	xmldata := fetchXML(ctx, "W-C0033-001")
+
+	v := &ResultWarning{}
+	if err := xml.Unmarshal([]byte(xmldata), v); err != nil {
+		return nil, err
 	}
 
-	log.Printf("[取得 %d 筆地區天氣警報資料]\n", len(v.Location))
+	logger.FromContext(ctx).Info("取得地區天氣警報資料", logger.Fields{"dataset": "W-C0033-001", "records": len(v.Location)})
+	recordsParsed.Set(float64(len(v.Location)), "W-C0033-001")
+	seen("W-C0033-001", v.Sent)
+
+	return v, nil
+}
+
+// GetWarningAlerts "豪大雨特報" as one alert per hazard in effect; township targets
+// receive the warnings of their county
+func GetWarningAlerts(ctx context.Context, targets []string) ([]Alert, string) {
+	var token = "W-C0033-001 "
+	targets = counties(targets)
+	var alerts = []Alert{}
+
+	v, err := FetchWarnings(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("GetWarningInfo fetchXML error", err, logger.Fields{"dataset": "W-C0033-001"})
+		return []Alert{}, ""
+	}
 
 	local := time.Now()
 	location, err := time.LoadLocation(timeZone)
@@ -210,43 +486,105 @@ func GetWarningInfo(targets []string) ([]string, string) {
 		local = local.In(location)
 	}
 
-	var hazardmsgs = ""
-
-	for i, location := range v.Location {
-		if i == 0 {
-			token = token + location.Hazards.ValidTime.StartTime.Format("20060102150405") + " " + location.Hazards.ValidTime.EndTime.Format("20060102150405")
-		}
-		if location.Hazards.Info.Phenomena != "" && location.Hazards.ValidTime.EndTime.After(local) {
-			if targets != nil {
-				for _, name := range targets {
-					if name == location.Name {
-						hazardmsgs = hazardmsgs + saveHazards(location) + "\n"
-					}
-				}
-			} else {
-				hazardmsgs = hazardmsgs + saveHazards(location) + "\n"
+	hash := sha256.New()
+	for _, location := range v.Location {
+		for _, hazard := range location.Hazards {
+			io.WriteString(hash, location.Name+"|"+hazard.key()+"\n")
+
+			if hazard.Active(local) && (targets == nil || contains(targets, location.Name)) {
+				alerts = append(alerts, Alert{
+					Dataset: "W-C0033-001",
+					Region:  location.Name,
+					Level:   warningLevel(hazard.Phenomena()),
+					Text:    saveHazards(location, hazard),
+					Key:     location.Name + "|" + hazard.key(),
+					Expires: hazard.ValidTime.EndTime,
+				})
 			}
 		}
 	}
+	token = token + hex.EncodeToString(hash.Sum(nil)[:12])
 
-	if hazardmsgs != "" {
-		msgs = append(msgs, hazardmsgs)
+	return alerts, token
+}
+
+// AlertsFor returns the alerts of the county of target
+func AlertsFor(alerts []Alert, target string) []Alert {
+	city := ParseTarget(target).City
+
+	var found = []Alert{}
+	for _, alert := range alerts {
+		if alert.Region == city {
+			found = append(found, alert)
+		}
 	}
+	return found
+}
 
-	return msgs, token
+// Fingerprint identifies the hazards in effect for target, so it changes exactly
+// when one of them is issued, lifted or amended; it is empty when there are none
+func Fingerprint(alerts []Alert, target string) string {
+	var keys []string
+	for _, alert := range AlertsFor(alerts, target) {
+		keys = append(keys, alert.Key)
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return ParseTarget(target).City + " " + hex.EncodeToString(sum[:12])
+}
+
+// Phenomena of the hazard, e.g. 大雨
+func (h Hazard) Phenomena() string {
+	return h.Info.Phenomena
+}
+
+// Significance of the hazard, e.g. 特報
+func (h Hazard) Significance() string {
+	return h.Info.Significance
+}
+
+// AffectedAreas lists the areas the hazard is limited to, if any
+func (h Hazard) AffectedAreas() []string {
+	var areas []string
+	for _, area := range h.HazardInfo.AffectedAreas {
+		areas = append(areas, area.Name)
+	}
+	return areas
+}
+
+// Level of the hazard
+func (h Hazard) Level() Level {
+	return warningLevel(h.Phenomena())
+}
+
+// Active reports whether the hazard is still in effect at t
+func (h Hazard) Active(t time.Time) bool {
+	return h.Info.Phenomena != "" && h.ValidTime.EndTime.After(t)
+}
+
+// key identifies the content of the hazard
+func (h Hazard) key() string {
+	return strings.Join([]string{
+		h.Phenomena(),
+		h.Significance(),
+		h.ValidTime.StartTime.Format("20060102150405"),
+		h.ValidTime.EndTime.Format("20060102150405"),
+		strings.Join(h.AffectedAreas(), ","),
+	}, "|")
 }
 
-func saveHazards(location Location1) string {
+func saveHazards(location Location1, hazard Hazard) string {
 	var m string
 
-	//log.Printf("【%s】%s%s\n %s ~\n %s\n", location.Name, location.Hazards.Info.Phenomena, location.Hazards.Info.Significance, location.Hazards.ValidTime.StartTime.Format("01/02 15:04"), location.Hazards.ValidTime.EndTime.Format("01/02 15:04"))
-	m = fmt.Sprintf("【%s】%s%s\n %s ~\n %s\n", location.Name, location.Hazards.Info.Phenomena, location.Hazards.Info.Significance, location.Hazards.ValidTime.StartTime.Format("01/02 15:04"), location.Hazards.ValidTime.EndTime.Format("01/02 15:04"))
-	if len(location.Hazards.HazardInfo.AffectedAreas) > 0 {
-		//log.Printf("影響地區：")
+	m = fmt.Sprintf("【%s】%s%s\n %s ~\n %s\n", location.Name, hazard.Phenomena(), hazard.Significance(), hazard.ValidTime.StartTime.Format("01/02 15:04"), hazard.ValidTime.EndTime.Format("01/02 15:04"))
+	if areas := hazard.AffectedAreas(); len(areas) > 0 {
 		m = m + "影響地區："
-		for _, str := range location.Hazards.HazardInfo.AffectedAreas {
-			//log.Printf("%s ", str.Name)
-			m = m + fmt.Sprintf("%s ", str.Name)
+		for _, area := range areas {
+			m = m + fmt.Sprintf("%s ", area)
 		}
 	}
 
@@ -0,0 +1,59 @@
+package rain
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Datasets are the CWB and NCDR datasets the bot downloads
+var Datasets = []string{"O-A0002-001", "W-C0033-001", "F-C0032-001", "NCDR"}
+
+// staleAfter is how long each dataset may go without a newer observation or issue
+var staleAfter = map[string]time.Duration{
+	"O-A0002-001": 30 * time.Minute,
+	"W-C0033-001": 3 * time.Hour,
+	"F-C0032-001": 12 * time.Hour,
+
+	// the NCDR feed only changes with its alerts, which may be quiet for a day
+	"NCDR": 24 * time.Hour,
+}
+
+var lastSeen = struct {
+	sync.Mutex
+	times map[string]time.Time
+}{times: map[string]time.Time{}}
+
+// StaleAfter returns the staleness threshold of dataset; STALE_AFTER_O_A0002_001 style variables override it
+func StaleAfter(dataset string) time.Duration {
+	key := "STALE_AFTER_" + strings.Replace(dataset, "-", "_", -1)
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	if d, ok := staleAfter[dataset]; ok {
+		return d
+	}
+	return time.Hour
+}
+
+// Stale reports whether data observed or issued at t is older than the threshold of dataset
+func Stale(dataset string, t time.Time, now time.Time) bool {
+	return !t.IsZero() && now.Sub(t) > StaleAfter(dataset)
+}
+
+func seen(dataset string, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	lastSeen.Lock()
+	lastSeen.times[dataset] = t
+	lastSeen.Unlock()
+}
+
+// LastSeen returns the latest observation or issue time of dataset in its last download
+func LastSeen(dataset string) time.Time {
+	lastSeen.Lock()
+	defer lastSeen.Unlock()
+	return lastSeen.times[dataset]
+}
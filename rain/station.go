@@ -0,0 +1,222 @@
+package rain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxCandidates is the number of stations listed when a lookup is ambiguous
+const maxCandidates = 5
+
+// minFuzzyQuery is the shortest query, in runes, matched by edit distance
+const minFuzzyQuery = 3
+
+// readingNames are the O-A0002-001 accumulations in display order
+var readingNames = []struct {
+	Element string
+	Label   string
+}{
+	{"MIN_10", "10分鐘雨量"},
+	{"RAIN", "時雨量"},
+	{"HOUR_3", "3小時雨量"},
+	{"HOUR_6", "6小時雨量"},
+	{"HOUR_12", "12小時雨量"},
+	{"HOUR_24", "24小時雨量"},
+	{"NOW", "本日雨量"},
+}
+
+// Station is one rain gauge of O-A0002-001, positioned in WGS 84
+type Station struct {
+	ID        string
+	Name      string
+	Town      string
+	City      string
+	Lat       float32
+	Lng       float32
+	Elevation float32
+	Time      time.Time
+	Readings  map[string]float32
+}
+
+// NewStation reads the station metadata and readings of location
+func NewStation(location Location0) Station {
+	point := location.Point()
+	s := Station{
+		ID:       location.StationID,
+		Name:     location.Name,
+		Lat:      float32(point.Lat),
+		Lng:      float32(point.Lon),
+		Time:     location.Time,
+		Readings: map[string]float32{},
+	}
+	s.City, s.Town = locationPlace(location)
+	for _, element := range location.WeatherElement {
+		if element.Name == "ELEV" {
+			s.Elevation = element.Value
+		} else {
+			s.Readings[element.Name] = element.Value
+		}
+	}
+	return s
+}
+
+// Level is the CWB grade of s, or LevelNone while its rain stays below the alert thresholds
+func (s Station) Level() Level {
+	if s.Readings["MIN_10"] < 5 && s.Readings["RAIN"] < DefaultHourly {
+		if l := rainLevel(s.Readings); l > LevelWatch {
+			return l
+		}
+		return LevelNone
+	}
+	return rainLevel(s.Readings)
+}
+
+// Text renders every reading of s
+func (s Station) Text() string {
+	msg := fmt.Sprintf("【%s】%s\n%s%s 海拔 %.0f 公尺\n", s.Name, s.ID, s.City, s.Town, s.Elevation)
+	for _, reading := range readingNames {
+		value, ok := s.Readings[reading.Element]
+		if !ok {
+			continue
+		}
+		if value < 0 {
+			msg = msg + fmt.Sprintf("%s：-\n", reading.Label)
+		} else {
+			msg = msg + fmt.Sprintf("%s：%.1f\n", reading.Label, value)
+		}
+	}
+
+	t := s.Time
+	if location, err := time.LoadLocation(timeZone); err == nil {
+		t = t.In(location)
+	}
+	return msg + "觀測時間：" + t.Format("01/02 15:04")
+}
+
+// StationIndex looks up stations by ID or name
+type StationIndex struct {
+	stations []Station
+	places   map[Target]bool
+}
+
+// NewStationIndex indexes the stations of locations
+func NewStationIndex(locations []Location0) *StationIndex {
+	index := &StationIndex{places: map[Target]bool{}}
+	for _, location := range locations {
+		s := NewStation(location)
+		index.stations = append(index.stations, s)
+		if s.City != "" {
+			index.places[Target{City: s.City}] = true
+			index.places[Target{City: s.City, Town: s.Town}] = true
+		}
+	}
+	return index
+}
+
+// IsTarget reports whether some station lies in the county or township target
+func (index *StationIndex) IsTarget(target string) bool {
+	return index.places[ParseTarget(target)]
+}
+
+// Lookup returns the stations best matching query: an exact ID or name,
+// then a name prefix, then a town prefix, then names within a small edit distance;
+// queries shorter than minFuzzyQuery runes only match exactly or by prefix
+func (index *StationIndex) Lookup(query string) []Station {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil
+	}
+
+	tiers := []func(s Station) bool{
+		func(s Station) bool { return strings.EqualFold(s.ID, query) || s.Name == query },
+		func(s Station) bool { return strings.HasPrefix(s.Name, query) },
+		func(s Station) bool { return s.Town != "" && strings.HasPrefix(s.Town, query) },
+	}
+	if len([]rune(query)) >= minFuzzyQuery {
+		tiers = append(tiers, func(s Station) bool { return distance(s.Name, query) <= maxDistance(query) })
+	}
+	for _, match := range tiers {
+		var found []Station
+		for _, s := range index.stations {
+			if match(s) {
+				found = append(found, s)
+			}
+		}
+		if len(found) > 0 {
+			return found
+		}
+	}
+	return nil
+}
+
+// maxDistance is the edit distance tolerated for a query, in runes
+func maxDistance(query string) int {
+	if len([]rune(query)) <= 3 {
+		return 1
+	}
+	return 2
+}
+
+// distance is the Levenshtein distance between a and b, in runes
+func distance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// StationInfo "雨量" of the station of locations matching query; it returns false when
+// query names a target or matches no station, so the caller can list the target instead
+func StationInfo(locations []Location0, query string) ([]string, bool) {
+	index := NewStationIndex(locations)
+	if index.IsTarget(query) {
+		return nil, false
+	}
+
+	stations := index.Lookup(query)
+	switch {
+	case len(stations) == 0:
+		return nil, false
+	case len(stations) == 1:
+		msgs := []string{stations[0].Text()}
+		if Stale("O-A0002-001", stations[0].Time, time.Now()) {
+			msgs = append(msgs, StaleNote(stations[0].Time))
+		}
+		return msgs, true
+	}
+
+	msg := fmt.Sprintf("找到 %d 個測站，請輸入測站代號：", len(stations))
+	for i, s := range stations {
+		if i == maxCandidates {
+			msg = msg + "\n…"
+			break
+		}
+		msg = msg + fmt.Sprintf("\n%s %s（%s%s）", s.ID, s.Name, s.City, s.Town)
+	}
+	return []string{msg}, true
+}
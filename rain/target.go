@@ -0,0 +1,116 @@
+package rain
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// targetSeparator separates the county from the township in a target
+const targetSeparator = "/"
+
+// DefaultTargets are the targets watched unless TARGETS lists others
+var DefaultTargets = []string{"新竹市", "新竹縣", "宜蘭縣"}
+
+// Targets reads TARGETS, a comma separated list of 縣市 or 縣市/鄉鎮市區,
+// e.g. "新竹市,新竹縣/尖石鄉"
+func Targets() []string {
+	var targets []string
+	for _, field := range strings.Split(os.Getenv("TARGETS"), ",") {
+		if t := ParseTarget(field); t.City != "" && !contains(targets, t.String()) {
+			targets = append(targets, t.String())
+		}
+	}
+	if len(targets) == 0 {
+		return DefaultTargets
+	}
+	return targets
+}
+
+// Target is a county, optionally narrowed to one of its townships, e.g. 新竹縣/尖石鄉
+type Target struct {
+	City string
+	Town string
+}
+
+// ParseTarget parses "縣市" or "縣市/鄉鎮市區"
+func ParseTarget(s string) Target {
+	parts := strings.SplitN(strings.TrimSpace(s), targetSeparator, 2)
+	t := Target{City: strings.TrimSpace(parts[0])}
+	if len(parts) == 2 {
+		t.Town = strings.TrimSpace(parts[1])
+	}
+	return t
+}
+
+// String formats t as ParseTarget reads it
+func (t Target) String() string {
+	if t.Town == "" {
+		return t.City
+	}
+	return t.City + targetSeparator + t.Town
+}
+
+// Matches reports whether a station in city and town belongs to t
+func (t Target) Matches(city string, town string) bool {
+	return t.City == city && (t.Town == "" || t.Town == town)
+}
+
+// matchTarget returns the first of targets covering city and town
+func matchTarget(targets []string, city string, town string) (string, bool) {
+	for _, target := range targets {
+		if ParseTarget(target).Matches(city, town) {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// counties reduces targets to their counties, for the datasets issued per county
+func counties(targets []string) []string {
+	if targets == nil {
+		return nil
+	}
+
+	var list = []string{}
+	for _, target := range targets {
+		if city := ParseTarget(target).City; !contains(list, city) {
+			list = append(list, city)
+		}
+	}
+	return list
+}
+
+// Cities lists the CITY of the stations of locations
+func Cities(locations []Location0) []string {
+	var cities = []string{}
+	for _, location := range locations {
+		if city, _ := locationPlace(location); city != "" && !contains(cities, city) {
+			cities = append(cities, city)
+		}
+	}
+	return cities
+}
+
+// locationPlace returns the CITY and TOWN parameters of location
+func locationPlace(location Location0) (string, string) {
+	var city, town string
+	for _, parameter := range location.Parameter {
+		switch parameter.Name {
+		case "CITY":
+			city = parameter.Value
+		case "TOWN":
+			town = parameter.Value
+		}
+	}
+	return city, town
+}
+
+// ValidTarget reports whether some O-A0002-001 station lies in target
+func ValidTarget(ctx context.Context, target string) (bool, error) {
+	locations, _, err := FetchRaining(ctx)
+	if err != nil {
+		return false, err
+	}
+	return NewStationIndex(locations).IsTarget(target), nil
+}
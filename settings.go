@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/geo"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/notify"
+	"github.com/lancetw/hcfd-forecast-v1/postback"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+	"github.com/lancetw/hcfd-forecast-v1/subscriber"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// regions selectable by the 「設定」 command, as configured by TARGETS
+var regions = rain.Targets()
+
+// maxButtons is the number of actions a buttons template holds
+const maxButtons = 4
+
+// thresholds (mm of hourly rain) selectable by the 「設定」 command
+var thresholds = []int{10, 20, 40, 80}
+
+// floors selectable by the 「等級」 command
+var floors = []rain.Level{rain.LevelHeavy, rain.LevelExtremelyHeavy, rain.LevelTorrential, rain.LevelExtremelyTorrential}
+
+func registerPostbacks(d *postback.Dispatcher) {
+	d.Handle("region", regionPostback)
+	d.Handle("threshold", thresholdPostback)
+	d.Handle("floor", floorPostback)
+}
+
+func postbackHandler(ctx context.Context, event *linebot.Event) {
+	lg := logger.FromContext(ctx)
+
+	if err := dispatcher.Dispatch(ctx, event); err != nil {
+		lg.Warn("Postback rejected", logger.Fields{"error": err.Error()})
+
+		text := "操作已失效，請重新輸入「設定」"
+		if _, replyErr := bot.ReplyMessage(
+			event.ReplyToken,
+			linebot.NewTextMessage(text)).Do(); replyErr != nil {
+			lg.Error("ReplyMessage error", replyErr)
+		}
+	}
+}
+
+// settingsCommand starts the 「設定」 flow by asking for a region;
+// 「設定 新竹縣/尖石鄉」 picks a county or township directly
+func settingsCommand(ctx context.Context, replyToken string, cmd []string) {
+	lg := logger.FromContext(ctx)
+
+	if len(cmd) > 1 {
+		valid, validErr := rain.ValidTarget(ctx, cmd[1])
+		if validErr != nil {
+			lg.Error("ValidTarget error", validErr)
+			reply(ctx, replyToken, "目前無法查詢地區，請稍後再試")
+			return
+		}
+		if !valid {
+			reply(ctx, replyToken, "找不到地區「"+cmd[1]+"」，請輸入 縣市 或 縣市/鄉鎮，例如「設定 新竹縣/尖石鄉」")
+			return
+		}
+		askThreshold(ctx, replyToken, rain.ParseTarget(cmd[1]).String())
+		return
+	}
+
+	var actions []linebot.TemplateAction
+	for i, region := range regions {
+		if i == maxButtons {
+			break
+		}
+		data, encodeErr := dispatcher.Data("region", url.Values{"r": {region}})
+		if encodeErr != nil {
+			lg.Error("Postback encode error", encodeErr)
+			return
+		}
+		actions = append(actions, linebot.NewPostbackTemplateAction(region, data, ""))
+	}
+
+	template := linebot.NewButtonsTemplate("", "設定", "請選擇要接收雨量警示的地區", actions...)
+	if _, replyErr := bot.ReplyMessage(
+		replyToken,
+		linebot.NewTemplateMessage("請選擇地區", template)).Do(); replyErr != nil {
+		lg.Error("ReplyMessage error", replyErr)
+	}
+}
+
+func regionPostback(ctx context.Context, event *linebot.Event, p *postback.Payload) {
+	askThreshold(ctx, event.ReplyToken, p.Args.Get("r"))
+}
+
+// askThreshold continues the 「設定」 flow of region by asking for a threshold
+func askThreshold(ctx context.Context, replyToken string, region string) {
+	lg := logger.FromContext(ctx)
+
+	var actions []linebot.TemplateAction
+	for _, mm := range thresholds {
+		data, encodeErr := dispatcher.Data("threshold", url.Values{"r": {region}, "mm": {strconv.Itoa(mm)}})
+		if encodeErr != nil {
+			lg.Error("Postback encode error", encodeErr)
+			return
+		}
+		actions = append(actions, linebot.NewPostbackTemplateAction(fmt.Sprintf("%d mm", mm), data, ""))
+	}
+
+	template := linebot.NewButtonsTemplate("", region, "請選擇時雨量警示門檻", actions...)
+	if _, replyErr := bot.ReplyMessage(
+		replyToken,
+		linebot.NewTemplateMessage("請選擇門檻", template)).Do(); replyErr != nil {
+		lg.Error("ReplyMessage error", replyErr)
+	}
+}
+
+func thresholdPostback(ctx context.Context, event *linebot.Event, p *postback.Payload) {
+	lg := logger.FromContext(ctx)
+
+	region := p.Args.Get("r")
+	mm := p.Args.Get("mm")
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	status, setErr := c.Do("HMSET", "pref:"+subscriber.ID(event.Source), "region", region, "threshold", mm)
+	if setErr != nil {
+		lg.Error("HMSET to redis error", setErr, logger.Fields{"status": status})
+		return
+	}
+
+	text := fmt.Sprintf("已設定地區「%s」，時雨量門檻 %s mm\n豪大雨特報僅傳送「%s」的特報", region, mm, rain.ParseTarget(region).City)
+	if _, replyErr := bot.ReplyMessage(
+		event.ReplyToken,
+		linebot.NewTextMessage(text)).Do(); replyErr != nil {
+		lg.Error("ReplyMessage error", replyErr)
+	}
+}
+
+func reply(ctx context.Context, replyToken string, text string) {
+	lg := logger.FromContext(ctx)
+
+	if _, replyErr := bot.ReplyMessage(
+		replyToken,
+		linebot.NewTextMessage(text)).Do(); replyErr != nil {
+		lg.Error("ReplyMessage error", replyErr)
+	}
+}
+
+// quietCommand handles 「安靜 23 7」 and 「安靜 關」
+func quietCommand(ctx context.Context, event *linebot.Event, cmd []string) {
+	lg := logger.FromContext(ctx)
+
+	usage := "用法：「安靜 23 7」設定 23:00 至 07:00 為靜音時段，「安靜 關」取消"
+
+	var start, end int
+	switch {
+	case len(cmd) == 2 && cmd[1] == "關":
+	case len(cmd) == 3:
+		var startErr, endErr error
+		start, startErr = strconv.Atoi(cmd[1])
+		end, endErr = strconv.Atoi(cmd[2])
+		if startErr != nil || endErr != nil || start < 0 || start > 23 || end < 0 || end > 23 || start == end {
+			reply(ctx, event.ReplyToken, usage)
+			return
+		}
+	default:
+		reply(ctx, event.ReplyToken, usage)
+		return
+	}
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	if setErr := subscriber.SetQuietHours(c, subscriber.ID(event.Source), start, end); setErr != nil {
+		lg.Error("SetQuietHours redis error", setErr)
+		return
+	}
+
+	if start == end {
+		reply(ctx, event.ReplyToken, "已取消靜音時段")
+		return
+	}
+
+	pref, _ := subscriber.Load(c, subscriber.ID(event.Source))
+	text := fmt.Sprintf("靜音時段 %02d:00 ~ %02d:00，期間僅即時傳送「%s」以上的警示，其餘於時段結束後以摘要傳送", start, end, pref.Floor)
+	reply(ctx, event.ReplyToken, text)
+}
+
+// floorCommand handles 「等級」 and 「等級 豪雨」
+func floorCommand(ctx context.Context, event *linebot.Event, cmd []string) {
+	lg := logger.FromContext(ctx)
+
+	if len(cmd) > 1 {
+		floor, ok := rain.ParseLevel(cmd[1])
+		if !ok || floor < rain.LevelHeavy || floor > rain.LevelExtremelyTorrential {
+			reply(ctx, event.ReplyToken, "無法辨識的等級，可用：大雨、豪雨、大豪雨、超大豪雨")
+			return
+		}
+		saveFloor(ctx, event, floor)
+		return
+	}
+
+	var actions []linebot.TemplateAction
+	for _, floor := range floors {
+		data, encodeErr := dispatcher.Data("floor", url.Values{"l": {strconv.Itoa(int(floor))}})
+		if encodeErr != nil {
+			lg.Error("Postback encode error", encodeErr)
+			return
+		}
+		actions = append(actions, linebot.NewPostbackTemplateAction(floor.String(), data, ""))
+	}
+
+	template := linebot.NewButtonsTemplate("", "等級", "靜音時段內僅即時傳送此等級以上的警示", actions...)
+	if _, replyErr := bot.ReplyMessage(
+		event.ReplyToken,
+		linebot.NewTemplateMessage("請選擇等級", template)).Do(); replyErr != nil {
+		lg.Error("ReplyMessage error", replyErr)
+	}
+}
+
+func floorPostback(ctx context.Context, event *linebot.Event, p *postback.Payload) {
+	level, parseErr := strconv.Atoi(p.Args.Get("l"))
+	if parseErr != nil {
+		logger.FromContext(ctx).Error("Postback level error", parseErr)
+		return
+	}
+	saveFloor(ctx, event, rain.Level(level))
+}
+
+func saveFloor(ctx context.Context, event *linebot.Event, floor rain.Level) {
+	lg := logger.FromContext(ctx)
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	if setErr := subscriber.SetFloor(c, subscriber.ID(event.Source), floor); setErr != nil {
+		lg.Error("SetFloor redis error", setErr)
+		return
+	}
+
+	reply(ctx, event.ReplyToken, fmt.Sprintf("已設定靜音時段內僅即時傳送「%s」以上的警示", floor))
+}
+
+// briefingCommand handles 「簡報」, 「簡報 開」, 「簡報 7」 and 「簡報 關」
+func briefingCommand(ctx context.Context, event *linebot.Event, cmd []string) {
+	lg := logger.FromContext(ctx)
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	id := subscriber.ID(event.Source)
+
+	if len(cmd) == 1 {
+		pref, _ := subscriber.Load(c, id)
+		reply(ctx, event.ReplyToken, rain.Briefing(ctx, []string{pref.Region}))
+		return
+	}
+
+	hour := subscriber.DefaultBriefingHour
+	switch cmd[1] {
+	case "開":
+	case "關":
+		hour = -1
+	default:
+		var parseErr error
+		hour, parseErr = strconv.Atoi(cmd[1])
+		if parseErr != nil || hour < 0 || hour > 23 {
+			reply(ctx, event.ReplyToken, "用法：「簡報」立即查看，「簡報 開」每日 08:00 傳送，「簡報 7」指定時間，「簡報 關」取消")
+			return
+		}
+	}
+
+	if setErr := subscriber.SetBriefing(c, id, hour); setErr != nil {
+		lg.Error("SetBriefing redis error", setErr)
+		return
+	}
+
+	if hour < 0 {
+		reply(ctx, event.ReplyToken, "已取消每日天氣簡報")
+		return
+	}
+	reply(ctx, event.ReplyToken, fmt.Sprintf("每日 %02d:00 將傳送天氣簡報（需先「加入」）", hour))
+}
+
+// areaCommand handles 「區域」 listing the uploaded areas, 「區域 <代號>」 and 「區域 取消」
+func areaCommand(ctx context.Context, event *linebot.Event, cmd []string) {
+	lg := logger.FromContext(ctx)
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	id := subscriber.ID(event.Source)
+
+	if len(cmd) == 1 {
+		areas, loadErr := geo.LoadAreas(c)
+		if loadErr != nil {
+			lg.Error("LoadAreas redis error", loadErr)
+			return
+		}
+		if len(areas) == 0 {
+			reply(ctx, event.ReplyToken, "目前沒有可訂閱的區域")
+			return
+		}
+
+		text := "可訂閱的區域："
+		for _, area := range areas {
+			text = text + fmt.Sprintf("\n%s %s", area.ID, area.Name)
+		}
+		reply(ctx, event.ReplyToken, text+"\n\n輸入「區域 <代號>」訂閱，「區域 取消」取消")
+		return
+	}
+
+	if cmd[1] == "取消" {
+		if setErr := subscriber.SetArea(c, id, ""); setErr != nil {
+			lg.Error("SetArea redis error", setErr)
+			return
+		}
+		reply(ctx, event.ReplyToken, "已取消訂閱區域")
+		return
+	}
+
+	area, ok, loadErr := geo.LoadArea(c, cmd[1])
+	if loadErr != nil {
+		lg.Error("LoadArea redis error", loadErr)
+		return
+	}
+	if !ok {
+		reply(ctx, event.ReplyToken, "找不到區域「"+cmd[1]+"」，輸入「區域」查看可訂閱的區域")
+		return
+	}
+
+	if setErr := subscriber.SetArea(c, id, area.ID); setErr != nil {
+		lg.Error("SetArea redis error", setErr)
+		return
+	}
+	reply(ctx, event.ReplyToken, fmt.Sprintf("已訂閱區域「%s」，區域內測站雨量及示警範圍涵蓋該區域時將通知您", area.Name))
+}
+
+// channels maps the names accepted by 「通知」 onto notification channels
+var channels = map[string]string{
+	"email":    "email",
+	"信箱":       "email",
+	"webhook":  "webhook",
+	"slack":    "slack",
+	"telegram": "telegram",
+}
+
+// validAddress checks the address of a channel; webhooks are limited to Slack and the
+// hosts of NOTIFY_WEBHOOK_HOSTS, e.g. a Mattermost server
+func validAddress(channel string, address string) bool {
+	switch channel {
+	case "email":
+		parsed, err := mail.ParseAddress(address)
+		return err == nil && parsed.Address == address
+	case "webhook":
+		n, ok := notify.WebhookFromEnv()
+		return ok && n.Allowed(address)
+	case "slack":
+		return notify.SlackFromEnv().Allowed(address)
+	case "telegram":
+		_, err := strconv.ParseInt(address, 10, 64)
+		return err == nil
+	}
+	return false
+}
+
+// redactAddress hides the path of webhook URLs, which is their secret
+func redactAddress(channel string, address string) string {
+	if channel != "webhook" && channel != "slack" {
+		return address
+	}
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host + "/…"
+	}
+	return "…"
+}
+
+// confirmCode draws the 6 digit code confirming an email address
+func confirmCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// channelCommand handles 「通知 email a@b.c」, 「通知 slack <url>」, 「通知 webhook <url>」,
+// 「通知 telegram <chat id>」, 「通知 確認 <確認碼>」 and 「通知 <channel> 關」;
+// an email address only receives alerts once its confirmation code is entered
+func channelCommand(ctx context.Context, event *linebot.Event, cmd []string) {
+	lg := logger.FromContext(ctx)
+
+	usage := "用法：「通知 email 信箱」「通知 slack 網址」「通知 webhook 網址」「通知 telegram 聊天代號」，「通知 確認 確認碼」確認信箱，「通知 email 關」取消"
+	if len(cmd) != 3 {
+		reply(ctx, event.ReplyToken, usage)
+		return
+	}
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	id := subscriber.ID(event.Source)
+
+	if cmd[1] == "確認" {
+		channel, address, ok, confirmErr := subscriber.Confirm(c, id, cmd[2])
+		if confirmErr != nil {
+			lg.Error("Confirm redis error", confirmErr)
+			return
+		}
+		if !ok {
+			reply(ctx, event.ReplyToken, "確認碼錯誤或已過期，請重新輸入「通知 email 信箱」")
+			return
+		}
+		reply(ctx, event.ReplyToken, "警示將同時傳送至 "+channel+"："+address)
+		return
+	}
+
+	channel, ok := channels[strings.ToLower(cmd[1])]
+	if !ok {
+		reply(ctx, event.ReplyToken, usage)
+		return
+	}
+
+	address := cmd[2]
+	if address == "關" {
+		if setErr := subscriber.SetChannel(c, id, channel, ""); setErr != nil {
+			lg.Error("SetChannel redis error", setErr)
+			return
+		}
+		reply(ctx, event.ReplyToken, "已取消 "+channel+" 通知")
+		return
+	}
+	if !validAddress(channel, address) {
+		reply(ctx, event.ReplyToken, "「"+redactAddress(channel, address)+"」無法使用\n"+usage)
+		return
+	}
+
+	if channel == "email" {
+		emailConfirmation(ctx, c, event, address)
+		return
+	}
+
+	if setErr := subscriber.SetChannel(c, id, channel, address); setErr != nil {
+		lg.Error("SetChannel redis error", setErr)
+		return
+	}
+	reply(ctx, event.ReplyToken, "警示將同時傳送至 "+channel+"："+redactAddress(channel, address))
+}
+
+// emailConfirmation mails a confirmation code to address and keeps the address pending until it is entered
+func emailConfirmation(ctx context.Context, c redis.Conn, event *linebot.Event, address string) {
+	lg := logger.FromContext(ctx)
+
+	mailer, ok := notify.SMTPFromEnv()
+	if !ok {
+		reply(ctx, event.ReplyToken, "目前未開放 email 通知")
+		return
+	}
+
+	code, codeErr := confirmCode()
+	if codeErr != nil {
+		lg.Error("Confirmation code error", codeErr)
+		return
+	}
+	if setErr := subscriber.SetPending(c, subscriber.ID(event.Source), "email", address, code); setErr != nil {
+		lg.Error("SetPending redis error", setErr)
+		return
+	}
+
+	text := fmt.Sprintf("您的確認碼為 %s，請於 %.0f 分鐘內在 LINE 輸入「通知 確認 %s」以接收天氣警示。\n若您未曾申請，請忽略此信。",
+		code, subscriber.ConfirmTTL.Minutes(), code)
+	if notifyErr := mailer.Notify(ctx, address, notify.Message{Title: "新竹天氣警示 信箱確認", Text: text, Time: time.Now()}); notifyErr != nil {
+		lg.Error("Confirmation mail error", notifyErr)
+		reply(ctx, event.ReplyToken, "確認信寄送失敗，請稍後再試")
+		return
+	}
+	reply(ctx, event.ReplyToken, "已寄出確認碼至 "+address+"，請輸入「通知 確認 <確認碼>」完成設定")
+}
+
+// preferencesText describes the preferences of a subscriber for 「狀態」
+func preferencesText(pref subscriber.Preferences) string {
+	text := fmt.Sprintf("地區：%s，時雨量門檻 %.0f mm（僅接收%s的特報）", pref.Region, pref.Threshold, rain.ParseTarget(pref.Region).City)
+	if pref.HasQuietHours() {
+		text = text + fmt.Sprintf("\n靜音時段：%02d:00 ~ %02d:00（%s以上即時傳送）", pref.QuietStart, pref.QuietEnd, pref.Floor)
+		if pref.Quiet(time.Now()) {
+			text = text + "\n目前為靜音時段"
+		}
+	}
+	if pref.BriefingHour >= 0 {
+		text = text + fmt.Sprintf("\n每日天氣簡報：%02d:00", pref.BriefingHour)
+	}
+	if pref.Area != "" {
+		text = text + "\n訂閱區域：" + pref.Area
+	}
+	for name, address := range pref.Channels {
+		text = text + "\n" + name + " 通知：" + redactAddress(name, address)
+	}
+	return text
+}
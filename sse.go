@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/metrics"
+	"github.com/lancetw/hcfd-forecast-v1/stream"
+)
+
+// streamHeartbeat keeps idle streams from being closed by proxies; Heroku cuts them after 55 seconds
+const streamHeartbeat = 25 * time.Second
+
+// streamRetry is the reconnection delay suggested to EventSource clients, in milliseconds
+const streamRetry = 5000
+
+// closing is closed on shutdown so the open streams end instead of holding it up
+var closing = make(chan struct{})
+
+var streamClients int64
+
+var streamClientsGauge = metrics.NewGauge(
+	"stream_clients",
+	"Clients connected to the alert stream.")
+
+// streamClientBuffer bounds the events waiting for a client; a client further behind
+// is dropped and resumes with Last-Event-ID
+const streamClientBuffer = 64
+
+// streamHub shares one Redis subscription among the stream clients of this process
+type streamHub struct {
+	mu        sync.Mutex
+	connected bool
+	clients   map[chan stream.Event]bool
+}
+
+var hub = &streamHub{clients: map[chan stream.Event]bool{}}
+
+// join registers a client, reporting false while the hub is not subscribed
+func (h *streamHub) join() (chan stream.Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.connected {
+		return nil, false
+	}
+	ch := make(chan stream.Event, streamClientBuffer)
+	h.clients[ch] = true
+	return ch, true
+}
+
+// leave unregisters the client of ch
+func (h *streamHub) leave(ch chan stream.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[ch] {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// broadcast hands e to every client, dropping those whose buffer is full
+func (h *streamHub) broadcast(e stream.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- e:
+		default:
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// setConnected records whether the hub is subscribed; on losing the subscription the
+// clients are dropped, as they would miss the events published until it is back
+func (h *streamHub) setConnected(connected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = connected
+	if !connected {
+		for ch := range h.clients {
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// run keeps the subscription until closing, resubscribing after streamRetry when it is lost
+func (h *streamHub) run() {
+	for {
+		h.subscribe()
+		select {
+		case <-closing:
+			return
+		case <-time.After(streamRetry * time.Millisecond):
+		}
+	}
+}
+
+func (h *streamHub) subscribe() {
+	lg := logger.Std.With(logger.Fields{"component": "stream"})
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		return
+	}
+	psc := redis.PubSubConn{Conn: c}
+	defer psc.Close()
+
+	if subscribeErr := psc.Subscribe(stream.Channel); subscribeErr != nil {
+		lg.Error("Stream subscribe redis error", subscribeErr)
+		return
+	}
+	h.setConnected(true)
+	defer h.setConnected(false)
+
+	// closing the connection ends Receive on shutdown
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-closing:
+			psc.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var e stream.Event
+			if json.Unmarshal(v.Data, &e) == nil {
+				h.broadcast(e)
+			}
+		case error:
+			select {
+			case <-closing:
+			default:
+				lg.Error("Stream subscription lost", v)
+			}
+			return
+		}
+	}
+}
+
+// writeEvent writes e in the text/event-stream format
+func writeEvent(w http.ResponseWriter, e stream.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// streamHandler streams the new, updated and cleared alerts as Server-Sent Events,
+// first replaying those after Last-Event-ID when the client resumes
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	lg := logger.Std.With(logger.Fields{"request": logger.NewID(), "path": r.URL.Path})
+
+	setCORS(w, r)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	last, _ := strconv.ParseInt(lastID, 10, 64)
+
+	// join before replaying, so nothing published in between is lost
+	events, ok := hub.join()
+	if !ok {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer hub.leave(events)
+
+	var replay []stream.Event
+	if lastID != "" {
+		c := db.Connect(os.Getenv("REDISTOGO_URL"))
+		if c != nil {
+			var sinceErr error
+			replay, sinceErr = stream.Since(c, last)
+			c.Close()
+			if sinceErr != nil {
+				lg.Error("Stream replay redis error", sinceErr)
+			}
+		}
+	}
+
+	n := atomic.AddInt64(&streamClients, 1)
+	streamClientsGauge.Set(float64(n))
+	defer func() {
+		streamClientsGauge.Set(float64(atomic.AddInt64(&streamClients, -1)))
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry)
+
+	for _, e := range replay {
+		if writeErr := writeEvent(w, e); writeErr != nil {
+			return
+		}
+		last = e.ID
+	}
+	flusher.Flush()
+	lg.Debug("Stream opened", logger.Fields{"resume": lastID, "replayed": len(replay)})
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	gone := r.Context().Done()
+	for {
+		select {
+		case e, open := <-events:
+			if !open {
+				lg.Warn("Stream client dropped")
+				return
+			}
+			// the events are published in the order of their IDs, so lower ones were replayed
+			if e.ID <= last {
+				continue
+			}
+			if writeErr := writeEvent(w, e); writeErr != nil {
+				return
+			}
+			last = e.ID
+		case <-heartbeat.C:
+			if _, writeErr := fmt.Fprint(w, ": ping\n\n"); writeErr != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-closing:
+			return
+		}
+		flusher.Flush()
+	}
+}
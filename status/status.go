@@ -0,0 +1,129 @@
+package status
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Job is the last run of a worker job
+type Job struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	Duration string    `json:"duration"`
+	Owner    string    `json:"owner"`
+}
+
+// Fetch is the last successful download of a CWB dataset
+type Fetch struct {
+	Dataset  string    `json:"dataset"`
+	Time     time.Time `json:"time"`
+	Observed time.Time `json:"observed"`
+	Token    string    `json:"token"`
+}
+
+// Report is the content of the /status page
+type Report struct {
+	Jobs        []Job   `json:"jobs"`
+	Fetches     []Fetch `json:"fetches"`
+	Subscribers int     `json:"subscribers"`
+	Outbox      int     `json:"outbox"`
+}
+
+// RecordJob stores the last run of the job name
+func RecordJob(c redis.Conn, name string, start time.Time, duration time.Duration, owner string) error {
+	c.Send("MULTI")
+	c.Send("SADD", "status:jobs", name)
+	c.Send("HMSET", "status:job:"+name,
+		"start", start.Unix(),
+		"duration", duration.String(),
+		"owner", owner)
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// RecordFetch stores a successful download of dataset, its latest observation time and dedupe token
+func RecordFetch(c redis.Conn, dataset string, observed time.Time, token string) error {
+	args := redis.Args{}.Add("status:fetch:"+dataset, "time", time.Now().Unix(), "token", token)
+	if !observed.IsZero() {
+		args = args.Add("observed", observed.Unix())
+	}
+
+	c.Send("MULTI")
+	c.Send("SADD", "status:fetches", dataset)
+	c.Send("HMSET", args...)
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// LastFetch returns the last successful download of dataset
+func LastFetch(c redis.Conn, dataset string) (Fetch, error) {
+	values, err := redis.StringMap(c.Do("HGETALL", "status:fetch:"+dataset))
+	if err != nil {
+		return Fetch{}, err
+	}
+
+	return Fetch{
+		Dataset:  dataset,
+		Time:     unix(values["time"]),
+		Observed: unix(values["observed"]),
+		Token:    values["token"],
+	}, nil
+}
+
+// Load gathers the report of every recorded job and fetch
+func Load(c redis.Conn) (*Report, error) {
+	report := &Report{Jobs: []Job{}, Fetches: []Fetch{}}
+
+	names, err := redis.Strings(c.Do("SMEMBERS", "status:jobs"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		values, jobErr := redis.StringMap(c.Do("HGETALL", "status:job:"+name))
+		if jobErr != nil {
+			return nil, jobErr
+		}
+		report.Jobs = append(report.Jobs, Job{
+			Name:     name,
+			Start:    unix(values["start"]),
+			Duration: values["duration"],
+			Owner:    values["owner"],
+		})
+	}
+
+	datasets, err := redis.Strings(c.Do("SMEMBERS", "status:fetches"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dataset := range datasets {
+		fetch, fetchErr := LastFetch(c, dataset)
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		report.Fetches = append(report.Fetches, fetch)
+	}
+
+	if report.Subscribers, err = redis.Int(c.Do("SCARD", "user")); err != nil {
+		return nil, err
+	}
+	if report.Outbox, err = redis.Int(c.Do("LLEN", "outbox")); err != nil {
+		return nil, err
+	}
+	retrying, err := redis.Int(c.Do("ZCARD", "outbox:retry"))
+	if err != nil {
+		return nil, err
+	}
+	report.Outbox += retrying
+
+	return report, nil
+}
+
+func unix(value string) time.Time {
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,178 @@
+package stream
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+)
+
+// Channel is the Redis pub/sub channel the events are published on
+const Channel = "stream"
+
+// logKey keeps the latest events, newest first, for clients resuming with Last-Event-ID
+const logKey = "stream:log"
+
+// logLength is the number of events kept for resuming
+const logLength = 1000
+
+// publishScript replaces the active alerts KEYS[1] by the ARGV[3] field and value pairs
+// that follow, then numbers each remaining event from KEYS[3] and logs it in KEYS[2] and
+// publishes it on ARGV[1], keeping ARGV[2] events; numbering and publishing in one script
+// keeps the events in the order of their IDs
+var publishScript = redis.NewScript(3, `
+redis.call("DEL", KEYS[1])
+local n = tonumber(ARGV[3])
+for i = 4, 3 + 2 * n, 2 do
+	redis.call("HSET", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+local ids = {}
+for i = 4 + 2 * n, #ARGV do
+	local e = cjson.decode(ARGV[i])
+	e.id = redis.call("INCR", KEYS[3])
+	local data = cjson.encode(e)
+	redis.call("LPUSH", KEYS[2], data)
+	redis.call("PUBLISH", ARGV[1], data)
+	table.insert(ids, e.id)
+end
+redis.call("LTRIM", KEYS[2], 0, tonumber(ARGV[2]) - 1)
+return ids`)
+
+// event types
+const (
+	New     = "new"
+	Updated = "updated"
+	Cleared = "cleared"
+)
+
+// Event is one change of the alerts in effect
+type Event struct {
+	ID      int64     `json:"id"`
+	Type    string    `json:"type"`
+	Alert   string    `json:"alert"`
+	Dataset string    `json:"dataset"`
+	Region  string    `json:"region"`
+	Level   string    `json:"level"`
+	Grade   int       `json:"grade"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+	Expires time.Time `json:"expires"`
+}
+
+func activeKey(dataset string) string {
+	return "stream:active:" + dataset
+}
+
+// identity follows an alert across updates: its Key, or its region and headline for
+// the rain alerts whose text carries the amounts
+func identity(alert rain.Alert) string {
+	if alert.Key != "" {
+		return alert.Key
+	}
+	return alert.Region + "|" + strings.SplitN(strings.TrimSpace(alert.Text), "\n", 2)[0]
+}
+
+// Diff compares the alerts of a dataset with the previous ones by identity
+func Diff(previous map[string]Event, alerts []rain.Alert, now time.Time) (map[string]Event, []Event) {
+	current := map[string]Event{}
+	var events []Event
+
+	for _, alert := range alerts {
+		e := Event{
+			Alert:   alert.ID(),
+			Dataset: alert.Dataset,
+			Region:  alert.Region,
+			Level:   alert.Level.String(),
+			Grade:   int(alert.Level),
+			Text:    alert.Text,
+			Time:    now,
+			Expires: alert.Expires,
+		}
+		key := identity(alert)
+		if _, seen := current[key]; seen {
+			continue
+		}
+
+		if old, ok := previous[key]; !ok {
+			e.Type = New
+			events = append(events, e)
+		} else if old.Text != e.Text || old.Grade != e.Grade {
+			e.Type = Updated
+			events = append(events, e)
+		} else {
+			e = old
+		}
+		current[key] = e
+	}
+
+	for key, old := range previous {
+		if _, ok := current[key]; !ok {
+			old.Type = Cleared
+			old.Time = now
+			events = append(events, old)
+		}
+	}
+
+	return current, events
+}
+
+// Publish records the alerts of dataset now in effect and publishes how they changed
+func Publish(c redis.Conn, dataset string, alerts []rain.Alert, now time.Time) ([]Event, error) {
+	values, err := redis.StringMap(c.Do("HGETALL", activeKey(dataset)))
+	if err != nil {
+		return nil, err
+	}
+
+	previous := map[string]Event{}
+	for key, data := range values {
+		var e Event
+		if json.Unmarshal([]byte(data), &e) == nil {
+			previous[key] = e
+		}
+	}
+
+	current, events := Diff(previous, alerts, now)
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	args := redis.Args{activeKey(dataset), logKey, "stream:seq", Channel, logLength, len(current)}
+	for key, e := range current {
+		data, _ := json.Marshal(e)
+		args = append(args, key, data)
+	}
+	for _, e := range events {
+		data, _ := json.Marshal(e)
+		args = append(args, data)
+	}
+
+	ids, err := redis.Values(publishScript.Do(c, args...))
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		if i < len(ids) {
+			events[i].ID, _ = redis.Int64(ids[i], nil)
+		}
+	}
+	return events, nil
+}
+
+// Since returns the kept events after id, oldest first
+func Since(c redis.Conn, id int64) ([]Event, error) {
+	values, err := redis.ByteSlices(c.Do("LRANGE", logKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	for i := len(values) - 1; i >= 0; i-- {
+		var e Event
+		if json.Unmarshal(values[i], &e) == nil && e.ID > id {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
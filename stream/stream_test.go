@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+)
+
+func TestDiff(t *testing.T) {
+	now := time.Date(2017, 6, 2, 8, 0, 0, 0, time.UTC)
+	station := func(text string, level rain.Level) rain.Alert {
+		return rain.Alert{Dataset: "O-A0002-001", Region: "新竹市", Level: level, Text: text}
+	}
+	warning := func(key string, text string) rain.Alert {
+		return rain.Alert{Dataset: "W-C0033-001", Region: "新竹縣", Level: rain.LevelHeavy, Text: text, Key: key}
+	}
+	previous := func(alerts ...rain.Alert) map[string]Event {
+		current, _ := Diff(nil, alerts, now.Add(-time.Hour))
+		return current
+	}
+
+	tests := []struct {
+		name     string
+		previous map[string]Event
+		alerts   []rain.Alert
+		want     []string
+	}{
+		{
+			"first alerts are new",
+			nil,
+			[]rain.Alert{station("【新竹】豪大雨警報\n(時雨量)：45.0", rain.LevelHeavy), warning("w1", "大雨特報")},
+			[]string{New + " 新竹市", New + " 新竹縣"},
+		},
+		{
+			"same alerts are unchanged",
+			previous(warning("w1", "大雨特報")),
+			[]rain.Alert{warning("w1", "大雨特報")},
+			nil,
+		},
+		{
+			"new amount of a station is an update",
+			previous(station("【新竹】豪大雨警報\n(時雨量)：45.0", rain.LevelHeavy)),
+			[]rain.Alert{station("【新竹】豪大雨警報\n(時雨量)：52.0", rain.LevelHeavy)},
+			[]string{Updated + " 新竹市"},
+		},
+		{
+			"new grade is an update",
+			previous(warning("w1", "大雨特報")),
+			[]rain.Alert{{Dataset: "W-C0033-001", Region: "新竹縣", Level: rain.LevelExtremelyHeavy, Text: "大雨特報", Key: "w1"}},
+			[]string{Updated + " 新竹縣"},
+		},
+		{
+			"missing alert is cleared",
+			previous(warning("w1", "大雨特報"), station("【新竹】豪大雨警報\n(時雨量)：45.0", rain.LevelHeavy)),
+			[]rain.Alert{warning("w1", "大雨特報")},
+			[]string{Cleared + " 新竹市"},
+		},
+		{
+			"replaced alert is new and cleared",
+			previous(warning("w1", "大雨特報")),
+			[]rain.Alert{warning("w2", "豪雨特報")},
+			[]string{Cleared + " 新竹縣", New + " 新竹縣"},
+		},
+		{
+			"duplicate identity counts once",
+			nil,
+			[]rain.Alert{warning("w1", "大雨特報"), warning("w1", "大雨特報")},
+			[]string{New + " 新竹縣"},
+		},
+	}
+
+	for _, tt := range tests {
+		current, events := Diff(tt.previous, tt.alerts, now)
+
+		var got []string
+		for _, e := range events {
+			got = append(got, e.Type+" "+e.Region)
+			if !e.Time.Equal(now) {
+				t.Errorf("%s: %s event at %v, want %v", tt.name, e.Type, e.Time, now)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(tt.want)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: events %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: events %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+
+		if len(current) != countIdentities(tt.alerts) {
+			t.Errorf("%s: %d alerts in effect, want %d", tt.name, len(current), countIdentities(tt.alerts))
+		}
+	}
+}
+
+func countIdentities(alerts []rain.Alert) int {
+	seen := map[string]bool{}
+	for _, alert := range alerts {
+		seen[identity(alert)] = true
+	}
+	return len(seen)
+}
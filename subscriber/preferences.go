@@ -0,0 +1,258 @@
+package subscriber
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+)
+
+// DefaultRegion is used when a subscriber has not chosen a region: the first of rain.Targets
+var DefaultRegion = rain.Targets()[0]
+
+// DefaultFloor is the quiet hours severity floor when none is chosen
+const DefaultFloor = rain.LevelExtremelyHeavy
+
+// DefaultBriefingHour is the shift change hour of the daily briefing
+const DefaultBriefingHour = 8
+
+// Preferences of one subscriber, stored in the "pref:<id>" hash
+type Preferences struct {
+	Region     string
+	Threshold  float32
+	QuietStart int
+	QuietEnd   int
+	Floor      rain.Level
+
+	// BriefingHour is the hour of the daily briefing, -1 when not opted in
+	BriefingHour int
+
+	// Area is the ID of an uploaded area also watched, empty when none
+	Area string
+
+	// Channels are the addresses of the extra notification channels by name, e.g. email
+	Channels map[string]string
+}
+
+// HasQuietHours reports whether quiet hours are set
+func (p Preferences) HasQuietHours() bool {
+	return p.QuietStart >= 0 && p.QuietEnd >= 0 && p.QuietStart != p.QuietEnd
+}
+
+// Quiet reports whether t falls in the quiet hours, in Asia/Taipei time
+func (p Preferences) Quiet(t time.Time) bool {
+	if !p.HasQuietHours() {
+		return false
+	}
+
+	location, err := time.LoadLocation(timeZone)
+	if err == nil {
+		t = t.In(location)
+	}
+
+	hour := t.Hour()
+	if p.QuietStart < p.QuietEnd {
+		return hour >= p.QuietStart && hour < p.QuietEnd
+	}
+	return hour >= p.QuietStart || hour < p.QuietEnd
+}
+
+// Deliver reports whether an alert of level should be pushed now rather than deferred
+func (p Preferences) Deliver(level rain.Level, t time.Time) bool {
+	return !p.Quiet(t) || level >= p.Floor
+}
+
+// Load reads the preferences of id, filling in defaults
+func Load(c redis.Conn, id string) (Preferences, error) {
+	p := Preferences{
+		Region:     DefaultRegion,
+		Threshold:  rain.DefaultHourly,
+		QuietStart: -1,
+		QuietEnd:   -1,
+		Floor:      DefaultFloor,
+
+		BriefingHour: -1,
+		Channels:     map[string]string{},
+	}
+
+	values, err := redis.StringMap(c.Do("HGETALL", prefKey(id)))
+	if err != nil {
+		return p, err
+	}
+
+	if region := values["region"]; region != "" {
+		p.Region = region
+	}
+	if threshold, parseErr := strconv.ParseFloat(values["threshold"], 32); parseErr == nil {
+		p.Threshold = float32(threshold)
+	}
+	if start, parseErr := strconv.Atoi(values["quiet_start"]); parseErr == nil {
+		p.QuietStart = start
+	}
+	if end, parseErr := strconv.Atoi(values["quiet_end"]); parseErr == nil {
+		p.QuietEnd = end
+	}
+	if floor, ok := rain.ParseLevel(values["floor"]); ok {
+		p.Floor = floor
+	}
+	if hour, parseErr := strconv.Atoi(values["briefing_hour"]); parseErr == nil {
+		p.BriefingHour = hour
+	}
+	p.Area = values["area"]
+	for field, value := range values {
+		if strings.HasPrefix(field, channelPrefix) {
+			p.Channels[strings.TrimPrefix(field, channelPrefix)] = value
+		}
+	}
+
+	return p, nil
+}
+
+// SetQuietHours stores quiet hours from start to end o'clock; equal hours turn them off
+func SetQuietHours(c redis.Conn, id string, start int, end int) error {
+	if start == end {
+		_, err := c.Do("HDEL", prefKey(id), "quiet_start", "quiet_end")
+		return err
+	}
+	_, err := c.Do("HMSET", prefKey(id), "quiet_start", start, "quiet_end", end)
+	return err
+}
+
+// SetFloor stores the minimum level delivered during quiet hours
+func SetFloor(c redis.Conn, id string, floor rain.Level) error {
+	_, err := c.Do("HSET", prefKey(id), "floor", floor.String())
+	return err
+}
+
+// SetBriefing opts id in to the daily briefing at hour o'clock; a negative hour opts out
+func SetBriefing(c redis.Conn, id string, hour int) error {
+	if hour < 0 {
+		_, err := c.Do("HDEL", prefKey(id), "briefing_hour")
+		return err
+	}
+	_, err := c.Do("HSET", prefKey(id), "briefing_hour", hour)
+	return err
+}
+
+// SetArea subscribes id to the uploaded area; an empty area unsubscribes
+func SetArea(c redis.Conn, id string, area string) error {
+	if area == "" {
+		_, err := c.Do("HDEL", prefKey(id), "area")
+		return err
+	}
+	_, err := c.Do("HSET", prefKey(id), "area", area)
+	return err
+}
+
+// channelPrefix marks the channel address fields of the "pref:<id>" hash
+const channelPrefix = "channel:"
+
+// SetChannel sets the address of id on the channel name; an empty address removes the channel
+func SetChannel(c redis.Conn, id string, name string, address string) error {
+	if address == "" {
+		_, err := c.Do("HDEL", prefKey(id), channelPrefix+name)
+		return err
+	}
+	_, err := c.Do("HSET", prefKey(id), channelPrefix+name, address)
+	return err
+}
+
+func confirmKey(id string) string {
+	return "confirm:" + id
+}
+
+// ConfirmTTL is how long a confirmation code stays valid
+const ConfirmTTL = time.Hour
+
+// maxConfirmAttempts is the number of wrong codes after which a pending address is dropped
+const maxConfirmAttempts = 5
+
+// SetPending keeps address on the channel name of id until Confirm receives code
+func SetPending(c redis.Conn, id string, name string, address string, code string) error {
+	c.Send("MULTI")
+	c.Send("DEL", confirmKey(id))
+	c.Send("HMSET", confirmKey(id), "channel", name, "address", address, "code", code)
+	c.Send("EXPIRE", confirmKey(id), int(ConfirmTTL/time.Second))
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Confirm sets the pending channel of id when code matches, returning its name and address;
+// it reports false for a wrong or expired code
+func Confirm(c redis.Conn, id string, code string) (string, string, bool, error) {
+	pending, err := redis.StringMap(c.Do("HGETALL", confirmKey(id)))
+	if err != nil || pending["code"] == "" {
+		return "", "", false, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(pending["code"]), []byte(code)) != 1 {
+		attempts, err := redis.Int(c.Do("HINCRBY", confirmKey(id), "attempts", 1))
+		if err == nil && attempts >= maxConfirmAttempts {
+			_, err = c.Do("DEL", confirmKey(id))
+		}
+		return "", "", false, err
+	}
+
+	if _, err := c.Do("DEL", confirmKey(id)); err != nil {
+		return "", "", false, err
+	}
+	if err := SetChannel(c, id, pending["channel"], pending["address"]); err != nil {
+		return "", "", false, err
+	}
+	return pending["channel"], pending["address"], true, nil
+}
+
+func digestKey(id string) string {
+	return "digest:" + id
+}
+
+// deferred is one alert kept for the digest
+type deferred struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// Defer keeps alert for the morning digest of id
+func Defer(c redis.Conn, id string, alert rain.Alert) error {
+	data, err := json.Marshal(deferred{ID: alert.ID(), Text: alert.Text})
+	if err != nil {
+		return err
+	}
+
+	c.Send("MULTI")
+	c.Send("RPUSH", digestKey(id), data)
+	c.Send("EXPIRE", digestKey(id), int(2*24*time.Hour/time.Second))
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// TakeDigest returns and clears the deferred texts of id, each alert once
+func TakeDigest(c redis.Conn, id string) ([]string, error) {
+	c.Send("MULTI")
+	c.Send("LRANGE", digestKey(id), 0, -1)
+	c.Send("DEL", digestKey(id))
+	values, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	items, err := redis.Strings(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var texts []string
+	seen := map[string]bool{}
+	for _, item := range items {
+		d := deferred{ID: item, Text: item}
+		json.Unmarshal([]byte(item), &d)
+		if !seen[d.ID] {
+			seen[d.ID] = true
+			texts = append(texts, d.Text)
+		}
+	}
+	return texts, nil
+}
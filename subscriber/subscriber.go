@@ -0,0 +1,141 @@
+package subscriber
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+const timeZone = "Asia/Taipei"
+
+// defaultWindow is how long preferences are kept after an unfollow
+const defaultWindow = 30 * 24 * time.Hour
+
+// churnRetention is how long the daily churn counters are kept
+const churnRetention = 90 * 24 * time.Hour
+
+// Churn reasons recorded in the daily statistics
+const (
+	Follow   = "follow"
+	Unfollow = "unfollow"
+	Join     = "join"
+	Leave    = "leave"
+	Restored = "restored"
+)
+
+// ID returns the push target of an event source: group, room or user
+func ID(source *linebot.EventSource) string {
+	switch source.Type {
+	case linebot.EventSourceTypeGroup:
+		return source.GroupID
+	case linebot.EventSourceTypeRoom:
+		return source.RoomID
+	}
+	return source.UserID
+}
+
+// Window reads REFOLLOW_WINDOW (e.g. "720h") for how long to keep preferences
+func Window() time.Duration {
+	if window, err := time.ParseDuration(os.Getenv("REFOLLOW_WINDOW")); err == nil {
+		return window
+	}
+	return defaultWindow
+}
+
+func prefKey(id string) string {
+	return "pref:" + id
+}
+
+func backupKey(id string) string {
+	return "prefbak:" + id
+}
+
+func churnKey(t time.Time) string {
+	location, err := time.LoadLocation(timeZone)
+	if err == nil {
+		t = t.In(location)
+	}
+	return "churn:" + t.Format("20060102")
+}
+
+// Record counts one churn event of reason for today
+func Record(c redis.Conn, reason string) error {
+	key := churnKey(time.Now())
+	c.Send("MULTI")
+	c.Send("HINCRBY", key, reason, 1)
+	c.Send("EXPIRE", key, int(churnRetention/time.Second))
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Remove unsubscribes id and keeps its preferences, if it has any, aside for window
+func Remove(c redis.Conn, id string, reason string, window time.Duration) error {
+	member, memberErr := redis.Int(c.Do("SISMEMBER", "user", id))
+	if memberErr != nil {
+		return memberErr
+	}
+
+	pref, prefErr := redis.Strings(c.Do("HGETALL", prefKey(id)))
+	if prefErr != nil {
+		return prefErr
+	}
+
+	key := churnKey(time.Now())
+	c.Send("MULTI")
+	c.Send("SREM", "user", id)
+	c.Send("DEL", prefKey(id), backupKey(id), digestKey(id))
+	if len(pref) > 0 {
+		c.Send("HMSET", redis.Args{}.Add(backupKey(id), "subscribed", member).AddFlat(pref)...)
+		c.Send("EXPIRE", backupKey(id), int(window/time.Second))
+	}
+	c.Send("HINCRBY", key, reason, 1)
+	c.Send("EXPIRE", key, int(churnRetention/time.Second))
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Restore brings back the subscription and preferences kept by Remove,
+// reporting whether there were preferences to restore
+func Restore(c redis.Conn, id string) (bool, error) {
+	backup, backupErr := redis.StringMap(c.Do("HGETALL", backupKey(id)))
+	if backupErr != nil || len(backup) == 0 {
+		return false, backupErr
+	}
+
+	subscribed := backup["subscribed"] == "1"
+	delete(backup, "subscribed")
+
+	key := churnKey(time.Now())
+	c.Send("MULTI")
+	if subscribed {
+		c.Send("SADD", "user", id)
+	}
+	if len(backup) > 0 {
+		c.Send("HMSET", redis.Args{}.Add(prefKey(id)).AddFlat(backup)...)
+		c.Send("HINCRBY", key, Restored, 1)
+		c.Send("EXPIRE", key, int(churnRetention/time.Second))
+	}
+	c.Send("DEL", backupKey(id))
+	_, err := c.Do("EXEC")
+	return err == nil && len(backup) > 0, err
+}
+
+// Churn sums the churn counters of the last days
+func Churn(c redis.Conn, days int) (map[string]int, error) {
+	total := map[string]int{}
+	now := time.Now()
+	for i := 0; i < days; i++ {
+		day, err := redis.StringMap(c.Do("HGETALL", churnKey(now.AddDate(0, 0, -i))))
+		if err != nil {
+			return nil, err
+		}
+		for reason, value := range day {
+			n, _ := strconv.Atoi(value)
+			total[reason] += n
+		}
+	}
+	return total, nil
+}
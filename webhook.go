@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/metrics"
+	"github.com/lancetw/hcfd-forecast-v1/subscriber"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// defaultWebhookWorkers is the number of event workers; WEBHOOK_WORKERS overrides it
+const defaultWebhookWorkers = 4
+
+// webhookQueueSize bounds the events waiting for each worker
+const webhookQueueSize = 100
+
+// webhookEventTTL is how long processed event IDs are remembered
+const webhookEventTTL = 24 * time.Hour
+
+var webhookQueueDepth = metrics.NewGauge(
+	"webhook_queue_depth",
+	"Webhook events waiting to be processed.")
+
+var webhookDuplicates = metrics.NewCounter(
+	"webhook_duplicates_total",
+	"Webhook events skipped because they were already processed.")
+
+var queue *eventQueue
+
+// queuedEvent is a webhook event waiting for a worker
+type queuedEvent struct {
+	id    string
+	event *linebot.Event
+	lg    *logger.Logger
+}
+
+// eventQueue processes events on bounded workers, keeping the events of
+// one user, group or room in order by always routing them to the same worker
+type eventQueue struct {
+	workers []chan queuedEvent
+	wg      sync.WaitGroup
+
+	// mu keeps push from sending on the channels closed by stop
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newEventQueue(n int) *eventQueue {
+	q := &eventQueue{}
+	for i := 0; i < n; i++ {
+		ch := make(chan queuedEvent, webhookQueueSize)
+		q.workers = append(q.workers, ch)
+
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for e := range ch {
+				webhookQueueDepth.Add(-1)
+				process(e)
+			}
+		}()
+	}
+	return q
+}
+
+// push queues the events of one delivery on the workers of their sources, all or none:
+// it reports false without queuing any when a worker lacks room for its share or the
+// queue is stopping
+func (q *eventQueue) push(events []queuedEvent) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+
+	// pushes are serialized by mu and workers only drain, so the room checked stays free
+	targets := make([]chan queuedEvent, len(events))
+	need := map[chan queuedEvent]int{}
+	for i, e := range events {
+		h := fnv.New32a()
+		h.Write([]byte(subscriber.ID(e.event.Source)))
+		targets[i] = q.workers[h.Sum32()%uint32(len(q.workers))]
+		need[targets[i]]++
+	}
+	for ch, n := range need {
+		if cap(ch)-len(ch) < n {
+			return false
+		}
+	}
+
+	for i, e := range events {
+		targets[i] <- e
+		webhookQueueDepth.Add(1)
+	}
+	return true
+}
+
+// stop waits until the queued events are processed or ctx is done
+func (q *eventQueue) stop(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, ch := range q.workers {
+			close(ch)
+		}
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// process handles e unless another delivery of the same event claimed it first;
+// the claim is dropped when handleEvent panics, leaving the event to a redelivery
+func process(e queuedEvent) {
+	key := "webhook:" + e.id
+	claimed := false
+	if c := db.Connect(os.Getenv("REDISTOGO_URL")); c != nil {
+		_, setErr := redis.String(c.Do("SET", key, 1, "NX", "EX", int(webhookEventTTL/time.Second)))
+		c.Close()
+		switch setErr {
+		case nil:
+			claimed = true
+		case redis.ErrNil:
+			webhookDuplicates.Inc()
+			e.lg.Info("Duplicate webhook event skipped")
+			return
+		default:
+			e.lg.Error("Webhook idempotency redis error", setErr)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			e.lg.Error("Webhook event panic", fmt.Errorf("%v", r))
+			if claimed {
+				release(e, key)
+			}
+		}
+	}()
+
+	start := time.Now()
+	handleEvent(logger.NewContext(context.Background(), e.lg), e.event)
+	e.lg.Debug("Webhook event done", logger.Fields{"duration": time.Since(start).String()})
+}
+
+// release drops the claim key of e so that a redelivery handles it again
+func release(e queuedEvent, key string) {
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	if _, delErr := c.Do("DEL", key); delErr != nil {
+		e.lg.Error("Webhook idempotency redis error", delErr)
+	}
+}
+
+// eventIDs reads the webhookEventId of each event, which the SDK does not expose,
+// falling back to a digest of the event for deliveries that lack one
+func eventIDs(body []byte, events []*linebot.Event) []string {
+	raw := struct {
+		Events []struct {
+			WebhookEventID string `json:"webhookEventId"`
+		} `json:"events"`
+	}{}
+	json.Unmarshal(body, &raw)
+
+	ids := make([]string, len(events))
+	for i, event := range events {
+		if i < len(raw.Events) && raw.Events[i].WebhookEventID != "" {
+			ids[i] = raw.Events[i].WebhookEventID
+			continue
+		}
+
+		data, _ := json.Marshal(event)
+		sum := sha256.Sum256(data)
+		ids[i] = hex.EncodeToString(sum[:12])
+	}
+	return ids
+}
+
+// webhookWorkers reads WEBHOOK_WORKERS
+func webhookWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("WEBHOOK_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultWebhookWorkers
+}
+
+// callbackHandler verifies the signature, queues the events and acknowledges at once
+func callbackHandler(w http.ResponseWriter, r *http.Request) {
+	body, readErr := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if readErr != nil {
+		w.WriteHeader(500)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	events, parseRequestErr := bot.ParseRequest(r)
+	if parseRequestErr != nil {
+		if parseRequestErr == linebot.ErrInvalidSignature {
+			w.WriteHeader(400)
+		} else {
+			w.WriteHeader(500)
+		}
+		return
+	}
+
+	requestID := logger.NewID()
+	ids := eventIDs(body, events)
+
+	queued := make([]queuedEvent, len(events))
+	for i, event := range events {
+		command := ""
+		if message, ok := event.Message.(*linebot.TextMessage); ok {
+			command = commandLabel(message.Text)
+		}
+		webhookEvents.Inc(string(event.Type), command)
+
+		lg := logger.Std.With(logger.Fields{
+			"request": requestID,
+			"webhook": ids[i],
+			"event":   string(event.Type),
+			"command": command,
+			"user":    logger.HashID(subscriber.ID(event.Source)),
+		})
+		lg.Info("Webhook event")
+		queued[i] = queuedEvent{id: ids[i], event: event, lg: lg}
+	}
+
+	if !queue.push(queued) {
+		logger.Std.Warn("Webhook queue full, asking LINE to redeliver", logger.Fields{"request": requestID, "events": len(queued)})
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
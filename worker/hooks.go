@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/hooks"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+)
+
+// publishHooks enqueues to each hook wanting dataset the alerts of its regions,
+// once per change of those alerts; alertsFor receives nil for hooks without regions
+func publishHooks(ctx context.Context, c redis.Conn, dataset string, alertsFor func(regions []string) []rain.Alert, now time.Time) {
+	lg := logger.FromContext(ctx)
+
+	list, loadErr := hooks.LoadAll(c)
+	if loadErr != nil {
+		lg.Error("Load hooks redis error", loadErr)
+		return
+	}
+
+	for _, h := range list {
+		if !h.Wants(dataset) {
+			continue
+		}
+
+		alerts := h.Filter(alertsFor(h.Regions))
+		if len(alerts) == 0 {
+			continue
+		}
+
+		token := h.ID + " " + dataset + " " + rain.Digest(alerts)
+		fresh, claimErr := leader.Claim(c, "token3", token)
+		if claimErr != nil {
+			lg.Error("Claim token3 error", claimErr)
+		}
+		if !fresh {
+			continue
+		}
+
+		for _, alert := range alerts {
+			if enqueueErr := hooks.Enqueue(c, h.ID, hooks.NewEvent(alert, now)); enqueueErr != nil {
+				lg.Error("Hook enqueue redis error", enqueueErr, logger.Fields{"hook": h.ID})
+			}
+		}
+		lg.Info("Hook alerts queued", logger.Fields{"hook": h.ID, "alerts": len(alerts)})
+	}
+}
+
+// regionAlerts keeps the alerts of the counties of regions, or all of them for nil regions
+func regionAlerts(alerts []rain.Alert, regions []string) []rain.Alert {
+	if regions == nil {
+		return alerts
+	}
+
+	var found []rain.Alert
+	seen := map[string]bool{}
+	for _, region := range regions {
+		for _, alert := range rain.AlertsFor(alerts, region) {
+			if !seen[alert.ID()] {
+				seen[alert.ID()] = true
+				found = append(found, alert)
+			}
+		}
+	}
+	return found
+}
+
+// HookProcess posts the due webhook deliveries
+func HookProcess(ctx context.Context) {
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	if processErr := hooks.Process(ctx, c, time.Now()); processErr != nil {
+		logger.FromContext(ctx).Error("Hook process redis error", processErr)
+	}
+}
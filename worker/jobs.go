@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/status"
+	"github.com/robfig/cron"
+)
+
+// Job is a named task run on its own schedule
+type Job struct {
+	Name     string
+	Schedule string
+	Enabled  bool
+
+	fn       func(ctx context.Context)
+	running  int32
+	registry *Registry
+}
+
+// Run runs the job on the leader unless its previous run is still in progress
+func (j *Job) Run() {
+	if j.registry.leader != nil && j.registry.leader.Lease() == nil {
+		return
+	}
+	lg := logger.Std.With(logger.Fields{"job": j.Name, "tick": logger.NewID()})
+
+	if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+		lg.Warn("上次執行尚未結束，略過")
+		return
+	}
+	defer atomic.StoreInt32(&j.running, 0)
+
+	if !j.registry.begin() {
+		return
+	}
+	defer j.registry.wg.Done()
+
+	start := time.Now()
+	j.fn(logger.NewContext(context.Background(), lg))
+	duration := time.Since(start)
+	lg.Info("Job done", logger.Fields{"duration": duration.String()})
+
+	owner := ""
+	if j.registry.leader != nil {
+		owner = j.registry.leader.owner
+	}
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	if recordErr := status.RecordJob(c, j.Name, start, duration, owner); recordErr != nil {
+		lg.Error("RecordJob redis error", recordErr)
+	}
+}
+
+// Registry schedules the jobs of the worker
+type Registry struct {
+	cron   *cron.Cron
+	jobs   []*Job
+	leader *Elector
+
+	// mu orders the wg.Add of starting jobs before the wg.Wait of Stop
+	mu      sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// NewRegistry creates a registry whose schedules are in location and
+// whose jobs only run while leader holds the lease
+func NewRegistry(location *time.Location, leader *Elector) *Registry {
+	return &Registry{
+		cron:   cron.NewWithLocation(location),
+		leader: leader,
+	}
+}
+
+// Register adds a job; JOB_<NAME>_SCHEDULE and JOB_<NAME>_ENABLED override its defaults
+func (r *Registry) Register(name string, schedule string, fn func(ctx context.Context)) *Job {
+	prefix := "JOB_" + strings.ToUpper(name) + "_"
+
+	j := &Job{
+		Name:     name,
+		Schedule: schedule,
+		Enabled:  true,
+		fn:       fn,
+		registry: r,
+	}
+	if s := os.Getenv(prefix + "SCHEDULE"); s != "" {
+		j.Schedule = s
+	}
+	if enabled, err := strconv.ParseBool(os.Getenv(prefix + "ENABLED")); err == nil {
+		j.Enabled = enabled
+	}
+
+	r.jobs = append(r.jobs, j)
+	return j
+}
+
+// Start schedules the enabled jobs
+func (r *Registry) Start() {
+	for _, j := range r.jobs {
+		lg := logger.Std.With(logger.Fields{"job": j.Name, "schedule": j.Schedule})
+		if !j.Enabled {
+			lg.Info("Job disabled")
+			continue
+		}
+		if addErr := r.cron.AddJob(j.Schedule, j); addErr != nil {
+			lg.Error("Job schedule error", addErr)
+			continue
+		}
+		lg.Info("Job scheduled")
+	}
+	r.cron.Start()
+}
+
+// begin counts a starting job as running, reporting false once Stop was called
+func (r *Registry) begin() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return false
+	}
+	r.wg.Add(1)
+	return true
+}
+
+// Stop stops scheduling and waits up to timeout for running jobs, reporting whether they finished
+func (r *Registry) Stop(timeout time.Duration) bool {
+	r.mu.Lock()
+	r.stopped = true
+	r.mu.Unlock()
+	r.cron.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+)
+
+// leaderKey is the Redis key of the worker leader lease
+const leaderKey = "lease:worker"
+
+// defaultLeaderTTL is how long a dead leader keeps the lease
+const defaultLeaderTTL = 30 * time.Second
+
+// claimRetention is how long a claimed token is remembered after it was last seen
+const claimRetention = 7 * 24 * time.Hour
+
+// Elector keeps one worker instance as leader through a Redis lease
+type Elector struct {
+	owner string
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	lease *db.Lease
+	stop  chan struct{}
+	done  chan struct{}
+
+	// deadline is when the held lease expires unless renewed
+	deadline time.Time
+}
+
+// NewElector creates an elector named after the dyno; LEADER_TTL overrides the lease TTL
+func NewElector() *Elector {
+	owner := os.Getenv("DYNO")
+	if owner == "" {
+		owner, _ = os.Hostname()
+	}
+	owner = fmt.Sprintf("%s/%d", owner, os.Getpid())
+
+	ttl := defaultLeaderTTL
+	if d, err := time.ParseDuration(os.Getenv("LEADER_TTL")); err == nil && d > 0 {
+		ttl = d
+	}
+
+	return &Elector{
+		owner: owner,
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start campaigns for the lease and renews it every third of its TTL
+func (e *Elector) Start() {
+	go func() {
+		defer close(e.done)
+
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			e.campaign()
+			select {
+			case <-ticker.C:
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (e *Elector) campaign() {
+	start := time.Now()
+	lease := e.Lease()
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		e.expire(lease, time.Now())
+		return
+	}
+	defer c.Close()
+
+	if lease != nil {
+		switch renewErr := lease.Renew(c); renewErr {
+		case nil:
+			e.mu.Lock()
+			e.deadline = start.Add(e.ttl)
+			e.mu.Unlock()
+		case db.ErrNotHeld:
+			e.log().Error("Leader lease lost", renewErr)
+			e.setLease(nil)
+		default:
+			// the lease may well still be ours; only give it up once it has surely expired
+			e.log().Error("Leader lease renew error", renewErr)
+			e.expire(lease, time.Now())
+		}
+		return
+	}
+
+	lease, acquireErr := db.Acquire(c, leaderKey, e.owner, e.ttl)
+	if acquireErr != nil {
+		if acquireErr != db.ErrNotHeld {
+			e.log().Error("Leader lease error", acquireErr)
+		}
+		return
+	}
+
+	e.log().Info("成為 leader", logger.Fields{"fence": lease.Token})
+	e.mu.Lock()
+	e.lease = lease
+	e.deadline = start.Add(e.ttl)
+	e.mu.Unlock()
+}
+
+// expire drops lease when it could not be renewed and its deadline has passed at now
+func (e *Elector) expire(lease *db.Lease, now time.Time) {
+	if lease == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease == lease && !now.Before(e.deadline) {
+		e.log().Warn("Leader lease expired", logger.Fields{"fence": lease.Token})
+		e.lease = nil
+	}
+}
+
+func (e *Elector) log() *logger.Logger {
+	return logger.Std.With(logger.Fields{"component": "leader", "owner": e.owner})
+}
+
+func (e *Elector) setLease(lease *db.Lease) {
+	e.mu.Lock()
+	e.lease = lease
+	e.mu.Unlock()
+}
+
+// Lease returns the held lease, or nil when this instance is not the leader
+func (e *Elector) Lease() *db.Lease {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lease
+}
+
+// Claim records member in set if this instance is still the leader, reporting whether it was new
+func (e *Elector) Claim(c redis.Conn, set string, member string) (bool, error) {
+	lease := e.Lease()
+	if lease == nil {
+		return false, db.ErrNotHeld
+	}
+	return lease.Claim(c, set, member, time.Now(), claimRetention)
+}
+
+// Stop stops campaigning and releases the lease so another instance takes over
+func (e *Elector) Stop() {
+	close(e.stop)
+	<-e.done
+
+	lease := e.Lease()
+	if lease == nil {
+		return
+	}
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	if releaseErr := lease.Release(c); releaseErr != nil {
+		e.log().Error("Leader lease release error", releaseErr)
+	}
+	e.setLease(nil)
+}
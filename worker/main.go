@@ -1,146 +1,495 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/geo"
+	"github.com/lancetw/hcfd-forecast-v1/history"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/metrics"
+	"github.com/lancetw/hcfd-forecast-v1/notify"
 	"github.com/lancetw/hcfd-forecast-v1/rain"
+	"github.com/lancetw/hcfd-forecast-v1/status"
+	"github.com/lancetw/hcfd-forecast-v1/subscriber"
 	"github.com/line/line-bot-sdk-go/linebot"
-	"github.com/robfig/cron"
 )
 
 const timeZone = "Asia/Taipei"
 
+// pushTitle heads alerts on the channels that have a title or subject
+const pushTitle = "新竹天氣警示"
+
+// defaultShutdownTimeout leaves a margin within the 30 seconds Heroku waits after SIGTERM
+const defaultShutdownTimeout = 25 * time.Second
+
+// digestLength keeps a digest within the LINE limit together with its time stamp
+const digestLength = 1980
+
+// defaultMetricsAddr serves /metrics of the worker
+const defaultMetricsAddr = ":9100"
+
 var bot *linebot.Client
+var leader *Elector
+var notifiers notify.Registry
 
 func main() {
-	c := cron.New()
-	c.AddFunc("0 */2 * * * *", GoProcess)
-	c.Start()
+	var err error
+	bot, err = linebot.New(os.Getenv("CHANNEL_SECRET"), os.Getenv("ACCESS_TOKEN"))
+	if err != nil {
+		logger.Std.Error("Bot init error", err)
+		return
+	}
+
+	location, timeZoneErr := time.LoadLocation(timeZone)
+	if timeZoneErr != nil {
+		location = time.Local
+	}
+
+	rain.SetCache(db.DatasetCache{URL: os.Getenv("REDISTOGO_URL")}, true)
+
+	notifiers = notify.FromEnv()
+	notifiers.Add(notify.LINE{Bot: bot})
+
+	checkTargets(logger.NewContext(context.Background(), logger.Std))
+
+	leader = NewElector()
+	leader.Start()
+
+	jobs := NewRegistry(location, leader)
+	jobs.Register("rain", "0 */2 * * * *", RainProcess)
+	jobs.Register("warning", "0 */2 * * * *", WarningProcess)
+	jobs.Register("cap", "20 */2 * * * *", CAPProcess)
+	jobs.Register("digest", "30 */2 * * * *", DigestProcess)
+	jobs.Register("briefing", "0 0 * * * *", BriefingProcess)
+	jobs.Register("outbox", "45 * * * * *", OutboxProcess)
+	jobs.Register("stale", "15 */5 * * * *", StaleProcess)
+	jobs.Register("hooks", "*/15 * * * * *", HookProcess)
+	jobs.Start()
+
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	if metricsAddr == "" {
+		metricsAddr = defaultMetricsAddr
+	}
+	go func() {
+		if listenErr := http.ListenAndServe(metricsAddr, metrics.Handler()); listenErr != nil {
+			logger.Std.Error("Metrics ListenAndServe error", listenErr)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
 
-	for {
-		time.Sleep(10000000000000)
-		fmt.Println("sleep")
+	timeout := defaultShutdownTimeout
+	if d, parseErr := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); parseErr == nil {
+		timeout = d
 	}
+
+	logger.Std.Info("Stopping jobs", logger.Fields{"signal": sig.String()})
+	stopDraining(time.Now().Add(timeout))
+	if !jobs.Stop(timeout) {
+		logger.Std.Warn("Jobs still running after shutdown timeout", logger.Fields{"timeout": timeout.String()})
+	}
+	leader.Stop()
 }
 
-// GoProcess is main process
-func GoProcess() {
-	var err error
-	bot, err = linebot.New(os.Getenv("CHANNEL_SECRET"), os.Getenv("ACCESS_TOKEN"))
-	if err != nil {
-		log.Println("Bot:", bot, " err:", err)
+// checkTargets warns about the configured TARGETS in which no O-A0002-001 station lies
+func checkTargets(ctx context.Context) {
+	lg := logger.FromContext(ctx)
+
+	locations, _, fetchErr := rain.FetchRaining(ctx)
+	if fetchErr != nil {
+		lg.Error("checkTargets fetchXML error", fetchErr)
 		return
 	}
 
-	log.Println("{$")
+	index := rain.NewStationIndex(locations)
+	for _, target := range rain.Targets() {
+		if !index.IsTarget(target) {
+			lg.Warn("找不到目標地區的測站", logger.Fields{"target": target})
+		}
+	}
+}
+
+// loadSubscribers returns the subscribers and their preferences
+func loadSubscribers(ctx context.Context, c redis.Conn) ([]string, map[string]subscriber.Preferences) {
+	lg := logger.FromContext(ctx)
+
+	users, smembersErr := redis.Strings(c.Do("SMEMBERS", "user"))
+	if smembersErr != nil {
+		lg.Error("SMEMBERS redis error", smembersErr)
+	}
+
+	prefs := map[string]subscriber.Preferences{}
+	for _, userID := range users {
+		pref, loadErr := subscriber.Load(c, userID)
+		if loadErr != nil {
+			lg.Error("Load preferences error", loadErr, logger.Fields{"user": logger.HashID(userID)})
+		}
+		prefs[userID] = pref
+	}
+
+	return users, prefs
+}
+
+// RainProcess pushes "雨量警示" of each subscriber's region once per observation
+func RainProcess(ctx context.Context) {
+	lg := logger.FromContext(ctx).With(logger.Fields{"dataset": "O-A0002-001"})
 
 	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
 
-	targets0 := []string{"新竹市"}
-	msgs0, token0 := rain.GetRainingInfo(targets0, false)
+	locations, token0, fetchErr := rain.FetchRaining(ctx)
+	if fetchErr != nil {
+		lg.Error("GetRainingInfo fetchXML error", fetchErr)
+	} else if recordErr := status.RecordFetch(c, "O-A0002-001", rain.LatestObservation(locations), token0); recordErr != nil {
+		lg.Error("RecordFetch redis error", recordErr)
+	}
 
 	if token0 != "" {
-		status0, getErr := redis.Int(c.Do("SISMEMBER", "token0", token0))
-		if getErr != nil {
-			log.Println(getErr)
+		fresh0, claimErr := leader.Claim(c, "token0", token0)
+		if claimErr != nil {
+			lg.Error("GetRainingInfo claim token0 error", claimErr)
 		}
+		lg.Debug("Claim token0", logger.Fields{"token": token0, "fresh": fresh0})
 
-		if status0 == 0 {
-			users0, smembersErr := redis.Strings(c.Do("SMEMBERS", "user"))
-
-			if smembersErr != nil {
-				log.Println("GetRainingInfo SMEMBERS redis error", smembersErr)
-			} else {
-				local := time.Now()
-				location, timeZoneErr := time.LoadLocation(timeZone)
-				if timeZoneErr == nil {
-					local = local.In(location)
+		if fresh0 {
+			now := time.Now()
+			counted := map[string]bool{}
+			users, prefs := loadSubscribers(ctx, c)
+			areas := loadAreas(ctx, c)
+			for _, userID := range users {
+				pref := prefs[userID]
+				alerts := rain.RainingAlerts(locations, []string{pref.Region}, pref.Threshold)
+				if area, ok := areas[pref.Area]; ok {
+					alerts = append(alerts, rain.AreaRainingAlerts(locations, area, pref.Threshold)...)
 				}
+				countAlerts(alerts, counted)
+				deliver(ctx, c, userID, pref, alerts, now)
+			}
+			drainOutbox(ctx, c)
 
-				now := local.Format("15:04:05")
-
-				if len(msgs0) > 0 {
-					var text string
-					for _, msg := range msgs0 {
-						text = text + msg + "\n\n"
-					}
-					text = strings.TrimSpace(text)
-					text = text + "\n\n" + now
-					log.Println(text)
-					for _, userID := range users0 {
-						if _, pushErr := bot.PushMessage(
-							userID,
-							linebot.NewTextMessage(text)).Do(); pushErr != nil {
-							log.Println(pushErr)
-						}
-					}
+			publishStream(ctx, c, "O-A0002-001", rain.RainingAlerts(locations, rain.Cities(locations), rain.DefaultHourly), now)
+			publishHooks(ctx, c, "O-A0002-001", func(regions []string) []rain.Alert {
+				if regions == nil {
+					regions = rain.Cities(locations)
 				}
-			}
+				return rain.RainingAlerts(locations, regions, rain.DefaultHourly)
+			}, now)
 		}
+	}
+}
 
-		n0, addErr := c.Do("SADD", "token0", token0)
-		if addErr != nil {
-			log.Println("GetRainingInfo SADD to redis error", addErr, n0)
+// WarningProcess pushes "豪大雨特報" to subscribers once per change of the hazards of their county
+func WarningProcess(ctx context.Context) {
+	lg := logger.FromContext(ctx).With(logger.Fields{"dataset": "W-C0033-001"})
+
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	alerts1, token1 := rain.GetWarningAlerts(ctx, nil)
+
+	if token1 != "" {
+		if recordErr := status.RecordFetch(c, "W-C0033-001", rain.LastSeen("W-C0033-001"), token1); recordErr != nil {
+			lg.Error("RecordFetch redis error", recordErr)
 		}
+
+		users, prefs := loadSubscribers(ctx, c)
+		pushPerTarget(ctx, c, "token1", users, prefs, alerts1, county)
+		drainOutbox(ctx, c)
+
+		publishStream(ctx, c, "W-C0033-001", alerts1, time.Now())
+		publishHooks(ctx, c, "W-C0033-001", func(regions []string) []rain.Alert {
+			return regionAlerts(alerts1, regions)
+		}, time.Now())
 	}
+}
 
-	targets1 := []string{"新竹市", "新竹縣", "宜蘭縣"}
-	msgs1, token1 := rain.GetWarningInfo(targets1)
+// CAPProcess pushes "NCDR 示警" to subscribers once per change of the CAP alerts of their county or area
+func CAPProcess(ctx context.Context) {
+	lg := logger.FromContext(ctx).With(logger.Fields{"dataset": "NCDR"})
 
-	if token1 != "" {
-		status1, getErr := redis.Int(c.Do("SISMEMBER", "token1", token1))
-		if getErr != nil {
-			log.Println(getErr)
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	caps, fetchErr := rain.FetchCAP(ctx)
+	if fetchErr != nil {
+		lg.Error("FetchCAP error", fetchErr)
+		return
+	}
+	if recordErr := status.RecordFetch(c, "NCDR", rain.LastSeen("NCDR"), ""); recordErr != nil {
+		lg.Error("RecordFetch redis error", recordErr)
+	}
+
+	users, prefs := loadSubscribers(ctx, c)
+	var counties []string
+	for _, userID := range users {
+		if city := county(prefs[userID]); !containsString(counties, city) {
+			counties = append(counties, city)
 		}
+	}
 
-		if status1 == 0 {
-			users1, smembersErr := redis.Strings(c.Do("SMEMBERS", "user"))
+	now := time.Now()
+	if retractErr := history.Retract(c, rain.Retracted(caps), now); retractErr != nil {
+		lg.Error("History retract redis error", retractErr)
+	}
 
-			if smembersErr != nil {
-				log.Println("GetWarningInfo SMEMBERS redis error", smembersErr)
-			} else {
-				local := time.Now()
-				location, locationErr := time.LoadLocation(timeZone)
-				if locationErr == nil {
-					local = local.In(location)
-				}
+	alerts2 := rain.CAPAlerts(caps, counties, now)
+	pushPerTarget(ctx, c, "token2", users, prefs, alerts2, county)
+
+	var watched []geo.Area
+	for _, area := range loadAreas(ctx, c) {
+		watched = append(watched, area)
+	}
+	areaAlerts := rain.CAPAreaAlerts(caps, watched, now)
+	pushPerTarget(ctx, c, "token2", users, prefs, areaAlerts, areaTarget)
+
+	drainOutbox(ctx, c)
+
+	publishStream(ctx, c, "NCDR", rain.CAPAlerts(caps, nil, now), now)
+	publishHooks(ctx, c, "NCDR", func(regions []string) []rain.Alert {
+		if regions == nil {
+			return rain.CAPAlerts(caps, nil, now)
+		}
+		var cities []string
+		for _, region := range regions {
+			if city := rain.ParseTarget(region).City; !containsString(cities, city) {
+				cities = append(cities, city)
+			}
+		}
+		return rain.CAPAlerts(caps, cities, now)
+	}, now)
+}
+
+// county is the target of the county alerts of a subscriber
+func county(pref subscriber.Preferences) string {
+	return rain.ParseTarget(pref.Region).City
+}
+
+// areaTarget is the target of the area alerts of a subscriber, empty without an area
+func areaTarget(pref subscriber.Preferences) string {
+	if pref.Area == "" {
+		return ""
+	}
+	return rain.AreaTarget(pref.Area)
+}
+
+// loadAreas reads the uploaded areas by ID
+func loadAreas(ctx context.Context, c redis.Conn) map[string]geo.Area {
+	areas := map[string]geo.Area{}
+
+	list, loadErr := geo.LoadAreas(c)
+	if loadErr != nil {
+		logger.FromContext(ctx).Error("LoadAreas redis error", loadErr)
+	}
+	for _, area := range list {
+		areas[area.ID] = area
+	}
+	return areas
+}
+
+// pushPerTarget delivers to each subscriber the alerts of their target, when the
+// fingerprint of those alerts is claimed for the first time in set
+func pushPerTarget(ctx context.Context, c redis.Conn, set string, users []string, prefs map[string]subscriber.Preferences, alerts []rain.Alert, targetOf func(subscriber.Preferences) string) {
+	lg := logger.FromContext(ctx)
+
+	now := time.Now()
+	counted := map[string]bool{}
+	fresh := map[string]bool{}
+	for _, userID := range users {
+		pref := prefs[userID]
+		target := targetOf(pref)
+		if target == "" {
+			continue
+		}
 
-				now := local.Format("15:04:05")
-
-				if len(msgs1) > 0 {
-					var text string
-					for _, msg := range msgs1 {
-						text = text + msg + "\n\n"
-					}
-					text = strings.TrimSpace(text)
-					text = text + "\n\n" + now
-					log.Println(text)
-					for _, userID := range users1 {
-						if _, pushErr := bot.PushMessage(
-							userID,
-							linebot.NewTextMessage(text)).Do(); pushErr != nil {
-							log.Println(pushErr)
-						}
-					}
+		claimedFresh, claimed := fresh[target]
+		if !claimed {
+			if fingerprint := rain.Fingerprint(alerts, target); fingerprint != "" {
+				var claimErr error
+				claimedFresh, claimErr = leader.Claim(c, set, fingerprint)
+				if claimErr != nil {
+					lg.Error("Claim "+set+" error", claimErr)
 				}
+				lg.Debug("Claim "+set, logger.Fields{"token": fingerprint, "fresh": claimedFresh})
 			}
+			fresh[target] = claimedFresh
+		}
+
+		if claimedFresh {
+			targetAlerts := rain.AlertsFor(alerts, target)
+			countAlerts(targetAlerts, counted)
+			deliver(ctx, c, userID, pref, targetAlerts, now)
 		}
 	}
+}
 
-	if token1 != "" {
-		n, addErr := c.Do("SADD", "token1", token1)
-		if addErr != nil {
-			log.Println("GetWarningInfo SADD to redis error", addErr, n)
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
 		}
 	}
+	return false
+}
 
+// DigestProcess pushes the alerts deferred during quiet hours once they are over
+func DigestProcess(ctx context.Context) {
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
 	defer c.Close()
 
-	log.Println("$}")
+	users, prefs := loadSubscribers(ctx, c)
+	flushDigests(ctx, c, users, prefs, time.Now())
+	drainOutbox(ctx, c)
+}
+
+// BriefingProcess pushes the daily briefing to subscribers whose briefing hour is now
+func BriefingProcess(ctx context.Context) {
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	now := time.Now()
+	local := now
+	location, timeZoneErr := time.LoadLocation(timeZone)
+	if timeZoneErr == nil {
+		local = local.In(location)
+	}
+
+	// fetched every hour, whether or not a briefing is due, so its staleness is watched
+	if _, forecastErr := rain.FetchForecast(ctx); forecastErr != nil {
+		logger.FromContext(ctx).Error("FetchForecast error", forecastErr, logger.Fields{"dataset": "F-C0032-001"})
+	} else if recordErr := status.RecordFetch(c, "F-C0032-001", rain.LastSeen("F-C0032-001"), ""); recordErr != nil {
+		logger.FromContext(ctx).Error("RecordFetch redis error", recordErr, logger.Fields{"dataset": "F-C0032-001"})
+	}
+
+	users, prefs := loadSubscribers(ctx, c)
+
+	briefings := map[string]string{}
+	for _, userID := range users {
+		pref := prefs[userID]
+		if pref.BriefingHour != local.Hour() {
+			continue
+		}
+
+		// once a day however often the job runs within the hour
+		fresh, claimErr := leader.Claim(c, "briefings", local.Format("20060102")+" "+userID)
+		if claimErr != nil {
+			logger.FromContext(ctx).Error("Claim briefings error", claimErr)
+		}
+		if !fresh {
+			continue
+		}
+
+		text, ok := briefings[pref.Region]
+		if !ok {
+			text = rain.Briefing(ctx, []string{pref.Region})
+			briefings[pref.Region] = text
+		}
+		push(ctx, c, userID, pref, text, now)
+	}
+
+	drainOutbox(ctx, c)
+
+	logger.FromContext(ctx).Info("已傳送天氣簡報", logger.Fields{"regions": len(briefings)})
+}
+
+// countAlerts records each alert not yet in counted
+func countAlerts(alerts []rain.Alert, counted map[string]bool) {
+	for _, alert := range alerts {
+		if counted[alert.Text] {
+			continue
+		}
+		counted[alert.Text] = true
+		rain.AlertsGenerated.Inc(alert.Dataset, alert.Region, alert.Level.String())
+	}
+}
+
+// deliver pushes alerts to userID now, or defers them during quiet hours, and
+// records them in the alert history
+func deliver(ctx context.Context, c redis.Conn, userID string, pref subscriber.Preferences, alerts []rain.Alert, now time.Time) {
+	recordIssued(ctx, c, alerts, now)
+
+	var text string
+	for _, alert := range alerts {
+		if pref.Deliver(alert.Level, now) {
+			text = text + alert.Text + "\n\n"
+		} else if deferErr := subscriber.Defer(c, userID, alert); deferErr != nil {
+			logger.FromContext(ctx).Error("Defer alert error", deferErr, logger.Fields{"user": logger.HashID(userID)})
+		}
+	}
+
+	if text != "" {
+		push(ctx, c, userID, pref, text, now)
+	}
+}
+
+// flushDigests pushes the alerts deferred during quiet hours once they are over
+func flushDigests(ctx context.Context, c redis.Conn, users []string, prefs map[string]subscriber.Preferences, now time.Time) {
+	for _, userID := range users {
+		if prefs[userID].Quiet(now) {
+			continue
+		}
+
+		msgs, takeErr := subscriber.TakeDigest(c, userID)
+		if takeErr != nil {
+			logger.FromContext(ctx).Error("TakeDigest redis error", takeErr, logger.Fields{"user": logger.HashID(userID)})
+			continue
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+
+		push(ctx, c, userID, prefs[userID], digestText(msgs), now)
+	}
+}
+
+// digestText joins the deferred texts within digestLength, telling how many were left out
+func digestText(msgs []string) string {
+	text := "【晨間摘要】靜音時段內的警示：\n\n"
+	for i, msg := range msgs {
+		next := text + msg + "\n\n"
+		limit := digestLength
+		if rest := len(msgs) - i - 1; rest > 0 {
+			// leave room to say how many follow
+			limit -= len([]rune(fmt.Sprintf("…還有 %d 則", rest)))
+		}
+		if len([]rune(next)) > limit {
+			return text + fmt.Sprintf("…還有 %d 則", len(msgs)-i)
+		}
+		text = next
+	}
+	return text
+}
+
+// push queues text for LINE and for every other channel of userID
+func push(ctx context.Context, c redis.Conn, userID string, pref subscriber.Preferences, text string, now time.Time) {
+	lg := logger.FromContext(ctx).With(logger.Fields{"user": logger.HashID(userID)})
+
+	location, timeZoneErr := time.LoadLocation(timeZone)
+	if timeZoneErr == nil {
+		now = now.In(location)
+	}
+	lg.Debug("Queue push", logger.Fields{"text": text})
+
+	deliveries := []Delivery{{To: userID, Channel: "line"}}
+	for name, address := range pref.Channels {
+		deliveries = append(deliveries, Delivery{To: address, Channel: name})
+	}
+
+	for _, d := range deliveries {
+		d.Title = pushTitle
+		d.Text = text
+		d.Time = now
+		if enqueueErr := enqueue(c, d); enqueueErr != nil {
+			lg.Error("Outbox RPUSH redis error", enqueueErr, logger.Fields{"channel": d.Channel})
+		}
+	}
 }
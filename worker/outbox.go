@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/metrics"
+	"github.com/lancetw/hcfd-forecast-v1/notify"
+)
+
+// outboxKey is the Redis list of pushes not yet sent
+const outboxKey = "outbox"
+
+// outboxRetryKey is the sorted set of pushes being sent or waiting to be retried,
+// scored by when they go back to the outbox
+const outboxRetryKey = "outbox:retry"
+
+// maxOutboxAttempts is the number of attempts before a push is given up
+const maxOutboxAttempts = 5
+
+// outboxRetryDelay is the delay before a failed push is attempted again
+const outboxRetryDelay = 2 * time.Minute
+
+// outboxInflightTimeout is how long a taken push waits before it is attempted again,
+// in case the worker sending it stops
+const outboxInflightTimeout = 5 * time.Minute
+
+// takeOutboxScript pops the first push of KEYS[1] into KEYS[2] at ARGV[1]
+var takeOutboxScript = redis.NewScript(2, `
+local data = redis.call("LPOP", KEYS[1])
+if data then
+	redis.call("ZADD", KEYS[2], ARGV[1], data)
+end
+return data`)
+
+// restoreOutboxScript moves the pushes of KEYS[2] due at ARGV[1] back to the outbox KEYS[1]
+var restoreOutboxScript = redis.NewScript(2, `
+local due = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[1])
+for _, data in ipairs(due) do
+	redis.call("ZREM", KEYS[2], data)
+	redis.call("RPUSH", KEYS[1], data)
+end
+return #due`)
+
+var pushesSent = metrics.NewCounter(
+	"pushes_sent_total",
+	"Pushes sent, by channel.",
+	"channel")
+
+var pushesFailed = metrics.NewCounter(
+	"pushes_failed_total",
+	"Pushes that failed, by channel and API status code.",
+	"channel", "code")
+
+var pushesDropped = metrics.NewCounter(
+	"pushes_dropped_total",
+	"Pushes given up after their last attempt, by channel.",
+	"channel")
+
+// errChannel is the error of pushes to a channel that is not configured
+var errChannel = errors.New("channel not configured")
+
+// errorCode is the API status of err, "refused" for addresses not allowed, or "network" for transport errors
+func errorCode(err error) string {
+	if statusErr, ok := err.(*notify.StatusError); ok {
+		return strconv.Itoa(statusErr.Code)
+	}
+	if err == notify.ErrAddress {
+		return "refused"
+	}
+	if err == errChannel {
+		return "unconfigured"
+	}
+	return "network"
+}
+
+// Delivery is one push waiting in the outbox; deliveries without a
+// channel were queued for LINE with the time already in their text
+type Delivery struct {
+	To      string    `json:"to"`
+	Text    string    `json:"text"`
+	Channel string    `json:"channel,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	Time    time.Time `json:"time,omitempty"`
+	Attempt int       `json:"attempt,omitempty"`
+}
+
+// drainDeadline is the UnixNano after which draining stops, 0 while running normally
+var drainDeadline int64
+
+// stopDraining makes drainOutbox leave the remaining deliveries for the next start after deadline
+func stopDraining(deadline time.Time) {
+	atomic.StoreInt64(&drainDeadline, deadline.UnixNano())
+}
+
+func drainExpired() bool {
+	deadline := atomic.LoadInt64(&drainDeadline)
+	return deadline != 0 && time.Now().UnixNano() > deadline
+}
+
+// enqueue persists a push so that it survives a restart in the middle of a fan-out
+func enqueue(c redis.Conn, d Delivery) error {
+	data, marshalErr := json.Marshal(d)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	_, err := c.Do("RPUSH", outboxKey, data)
+	return err
+}
+
+// drainOutbox sends the queued pushes until the outbox is empty or the shutdown deadline passes;
+// a push stays in outboxRetryKey until it is sent, so one interrupted by a restart is sent
+// again after outboxInflightTimeout, and failed pushes are retried up to maxOutboxAttempts times
+func drainOutbox(ctx context.Context, c redis.Conn) {
+	lg := logger.FromContext(ctx)
+
+	if _, restoreErr := restoreOutboxScript.Do(c, outboxKey, outboxRetryKey, time.Now().Unix()); restoreErr != nil {
+		lg.Error("Outbox restore redis error", restoreErr)
+		return
+	}
+
+	for !drainExpired() {
+		now := time.Now()
+		data, takeErr := redis.Bytes(takeOutboxScript.Do(c, outboxKey, outboxRetryKey, now.Add(outboxInflightTimeout).Unix()))
+		if takeErr == redis.ErrNil {
+			break
+		}
+		if takeErr != nil {
+			lg.Error("Outbox take redis error", takeErr)
+			return
+		}
+
+		var d Delivery
+		if unmarshalErr := json.Unmarshal(data, &d); unmarshalErr != nil {
+			lg.Error("Outbox delivery error", unmarshalErr)
+			if _, remErr := c.Do("ZREM", outboxRetryKey, data); remErr != nil {
+				lg.Error("Outbox ZREM redis error", remErr)
+			}
+			continue
+		}
+
+		if d.Channel == "" {
+			d.Channel = "line"
+		}
+		d.Attempt++
+		fields := logger.Fields{"user": logger.HashID(d.To), "channel": d.Channel, "attempt": d.Attempt}
+
+		var notifyErr error
+		if notifier, ok := notifiers[d.Channel]; ok {
+			notifyErr = notifier.Notify(ctx, d.To, notify.Message{Title: d.Title, Text: d.Text, Time: d.Time})
+		} else {
+			notifyErr = errChannel
+		}
+
+		if notifyErr == nil {
+			pushesSent.Inc(d.Channel)
+			lg.Debug("Notify", fields)
+			if _, remErr := c.Do("ZREM", outboxRetryKey, data); remErr != nil {
+				lg.Error("Outbox ZREM redis error", remErr)
+			}
+			continue
+		}
+
+		fields["code"] = errorCode(notifyErr)
+		pushesFailed.Inc(d.Channel, errorCode(notifyErr))
+		if d.Attempt >= maxOutboxAttempts {
+			pushesDropped.Inc(d.Channel)
+			lg.Error("Notify given up", notifyErr, fields)
+			if _, remErr := c.Do("ZREM", outboxRetryKey, data); remErr != nil {
+				lg.Error("Outbox ZREM redis error", remErr)
+			}
+			continue
+		}
+
+		fields["error"] = notifyErr.Error()
+		lg.Warn("Notify failed, retrying", fields)
+		if retryErr := retryDelivery(c, data, d, now.Add(outboxRetryDelay)); retryErr != nil {
+			lg.Error("Outbox retry redis error", retryErr)
+		}
+	}
+
+	if n, lenErr := redis.Int(c.Do("LLEN", outboxKey)); lenErr == nil && n > 0 {
+		lg.Warn("尚有未傳送訊息，待下次啟動繼續", logger.Fields{"outbox": n})
+	}
+}
+
+// retryDelivery replaces the taken push data by d, due back in the outbox at
+func retryDelivery(c redis.Conn, data []byte, d Delivery, at time.Time) error {
+	next, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	c.Send("MULTI")
+	c.Send("ZREM", outboxRetryKey, data)
+	c.Send("ZADD", outboxRetryKey, at.Unix(), next)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// OutboxProcess resumes deliveries left over by a previous run
+func OutboxProcess(ctx context.Context) {
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	drainOutbox(ctx, c)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/db"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/metrics"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+	"github.com/lancetw/hcfd-forecast-v1/status"
+	"github.com/lancetw/hcfd-forecast-v1/subscriber"
+)
+
+var dataAge = metrics.NewGauge(
+	"cwb_data_age_seconds",
+	"Age of the latest observation or issue of each dataset.",
+	"dataset")
+
+// adminIDs reads the LINE IDs of administrators from ADMIN_IDS, comma separated
+func adminIDs() []string {
+	var ids []string
+	for _, id := range strings.Split(os.Getenv("ADMIN_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// StaleProcess alerts administrators once when a dataset stops updating and again when it recovers
+func StaleProcess(ctx context.Context) {
+	c := db.Connect(os.Getenv("REDISTOGO_URL"))
+	defer c.Close()
+
+	now := time.Now()
+	admins := adminIDs()
+
+	for _, dataset := range rain.Datasets {
+		lg := logger.FromContext(ctx).With(logger.Fields{"dataset": dataset})
+
+		fetch, fetchErr := status.LastFetch(c, dataset)
+		if fetchErr != nil {
+			lg.Error("LastFetch redis error", fetchErr)
+			continue
+		}
+		if fetch.Time.IsZero() {
+			continue
+		}
+
+		latest := fetch.Observed
+		if latest.IsZero() {
+			latest = fetch.Time
+		}
+		dataAge.Set(now.Sub(latest).Seconds(), dataset)
+
+		key := "stale:" + dataset
+		alerted, existsErr := redis.Bool(c.Do("EXISTS", key))
+		if existsErr != nil {
+			lg.Error("EXISTS redis error", existsErr)
+			continue
+		}
+
+		var text string
+		switch stale := rain.Stale(dataset, latest, now); {
+		case stale && !alerted:
+			lg.Warn("Dataset stale", logger.Fields{"latest": latest.Format(time.RFC3339)})
+			text = fmt.Sprintf("【資料逾時】%s 已超過 %s 未更新\n%s", dataset, rain.StaleAfter(dataset), rain.StaleNote(latest))
+			if _, setErr := c.Do("SET", key, latest.Unix()); setErr != nil {
+				lg.Error("SET redis error", setErr)
+			}
+		case !stale && alerted:
+			lg.Info("Dataset recovered", logger.Fields{"latest": latest.Format(time.RFC3339)})
+			text = fmt.Sprintf("【資料恢復】%s 已恢復更新", dataset)
+			if _, delErr := c.Do("DEL", key); delErr != nil {
+				lg.Error("DEL redis error", delErr)
+			}
+		}
+
+		if text != "" {
+			for _, adminID := range admins {
+				push(ctx, c, adminID, subscriber.Preferences{}, text, now)
+			}
+		}
+	}
+
+	drainOutbox(ctx, c)
+}
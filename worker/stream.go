@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lancetw/hcfd-forecast-v1/history"
+	"github.com/lancetw/hcfd-forecast-v1/logger"
+	"github.com/lancetw/hcfd-forecast-v1/rain"
+	"github.com/lancetw/hcfd-forecast-v1/stream"
+)
+
+// publishStream publishes to the live stream how the alerts of dataset in effect changed
+func publishStream(ctx context.Context, c redis.Conn, dataset string, alerts []rain.Alert, now time.Time) {
+	lg := logger.FromContext(ctx).With(logger.Fields{"dataset": dataset})
+
+	events, err := stream.Publish(c, dataset, alerts, now)
+	if err != nil {
+		lg.Error("Stream publish redis error", err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+	lg.Debug("Stream events published", logger.Fields{"events": len(events)})
+}
+
+// recordIssued keeps in the alert history the alerts issued to a subscriber for the first time
+func recordIssued(ctx context.Context, c redis.Conn, alerts []rain.Alert, now time.Time) {
+	lg := logger.FromContext(ctx)
+
+	var entries []history.Entry
+	for _, alert := range alerts {
+		fresh, claimErr := leader.Claim(c, "issued", alert.ID())
+		if claimErr != nil {
+			lg.Error("Claim issued error", claimErr)
+		}
+		if fresh {
+			entries = append(entries, history.NewEntry(alert, now))
+		}
+	}
+	if recordErr := history.Record(c, entries, now); recordErr != nil {
+		lg.Error("History redis error", recordErr)
+	}
+}